@@ -0,0 +1,240 @@
+package wireproxy
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+const amneziaLinkPrefix = "vpn://"
+
+// amneziaASecKeys are the AWG parameters carried by an AmneziaVPN configuration
+var amneziaASecKeys = []string{
+	"Jc", "Jmin", "Jmax", "S1", "S2", "S3", "S4",
+	"H1", "H2", "H3", "H4", "I1", "I2", "I3", "I4", "I5",
+}
+
+// IsAmneziaLink reports whether config is an AmneziaVPN vpn:// link
+func IsAmneziaLink(config string) bool {
+	return strings.HasPrefix(strings.TrimSpace(config), amneziaLinkPrefix)
+}
+
+// DecodeAmneziaLink returns the JSON document held by an AmneziaVPN vpn:// link.
+// The link is the url-safe base64 encoding of the document compressed with qCompress,
+// that is a big-endian uint32 holding the uncompressed size followed by a zlib stream.
+func DecodeAmneziaLink(link string) ([]byte, error) {
+	encoded, ok := strings.CutPrefix(strings.TrimSpace(link), amneziaLinkPrefix)
+	if !ok {
+		return nil, errors.New("vpn link should start with " + amneziaLinkPrefix)
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid vpn link: %w", err)
+	}
+	if len(data) < 4 {
+		return nil, errors.New("invalid vpn link: too short")
+	}
+
+	size := binary.BigEndian.Uint32(data[:4])
+	reader, err := zlib.NewReader(bytes.NewReader(data[4:]))
+	if err != nil {
+		// Links without compression hold the document directly
+		if json.Valid(data) {
+			return data, nil
+		}
+		return nil, fmt.Errorf("invalid vpn link: %w", err)
+	}
+	defer reader.Close()
+
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vpn link: %w", err)
+	}
+	if uint32(len(decoded)) != size {
+		return nil, errors.New("invalid vpn link: size mismatch")
+	}
+	return decoded, nil
+}
+
+// ParseAmneziaConfig parses an AmneziaVPN vpn:// link, or the JSON exported by the
+// Amnezia client, into a DeviceConfig
+func ParseAmneziaConfig(config string) (*DeviceConfig, error) {
+	data := []byte(config)
+	if IsAmneziaLink(config) {
+		var err error
+		data, err = DecodeAmneziaLink(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var doc map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid Amnezia configuration: %w", err)
+	}
+
+	lastConfig, protocol, err := amneziaProtocolConfig(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := amneziaToINI(doc, lastConfig, protocol)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkImportedValues(cfg); err != nil {
+		return nil, err
+	}
+	return parseDevice(cfg)
+}
+
+// amneziaProtocolConfig finds the configuration of the AmneziaWG or WireGuard container
+// of doc, returning its decoded last_config along with the container settings.
+// A document without containers is taken as a last_config on its own.
+func amneziaProtocolConfig(doc map[string]any) (map[string]any, map[string]any, error) {
+	containers, ok := doc["containers"].([]any)
+	if !ok {
+		return doc, nil, nil
+	}
+
+	defaultContainer := amneziaString(doc, "defaultContainer")
+	var protocol map[string]any
+	for _, item := range containers {
+		container, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		for _, name := range []string{"awg", "wireguard"} {
+			settings, ok := container[name].(map[string]any)
+			if !ok {
+				continue
+			}
+			if protocol == nil || amneziaString(container, "container") == defaultContainer {
+				protocol = settings
+			}
+		}
+	}
+	if protocol == nil {
+		return nil, nil, errors.New("no AmneziaWG or WireGuard container in the Amnezia configuration")
+	}
+
+	raw := amneziaString(protocol, "last_config")
+	if raw == "" {
+		return nil, nil, errors.New("the Amnezia configuration holds no client configuration")
+	}
+
+	var lastConfig map[string]any
+	dec := json.NewDecoder(strings.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&lastConfig); err != nil {
+		return nil, nil, fmt.Errorf("invalid last_config: %w", err)
+	}
+	return lastConfig, protocol, nil
+}
+
+// amneziaToINI lays the client configuration out as the equivalent wg-quick file
+func amneziaToINI(doc, lastConfig, protocol map[string]any) (*ini.File, error) {
+	lookup := func(key string) string {
+		for _, m := range []map[string]any{lastConfig, protocol, doc} {
+			if value := amneziaString(m, key); value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+
+	cfg := ini.Empty(ini.LoadOptions{
+		Insensitive:            true,
+		AllowShadows:           true,
+		AllowNonUniqueSections: true,
+	})
+
+	iface, err := cfg.NewSection("Interface")
+	if err != nil {
+		return nil, err
+	}
+	setKey(iface, "PrivateKey", lookup("client_priv_key"))
+	setKey(iface, "Address", lookup("client_ip"))
+	setList(iface, "DNS", amneziaDNS(doc))
+	setKey(iface, "MTU", lookup("mtu"))
+	for _, key := range amneziaASecKeys {
+		setKey(iface, key, lookup(key))
+	}
+
+	peer, err := cfg.NewSection("Peer")
+	if err != nil {
+		return nil, err
+	}
+	setKey(peer, "PublicKey", lookup("server_pub_key"))
+	setKey(peer, "PreSharedKey", lookup("psk_key"))
+	if host, port := lookup("hostName"), lookup("port"); host != "" && port != "" {
+		setKey(peer, "Endpoint", net.JoinHostPort(host, port))
+	}
+	setKey(peer, "PersistentKeepalive", lookup("persistent_keep_alive"))
+
+	allowedIPs := "0.0.0.0/0, ::/0"
+	if values, ok := lastConfig["allowed_ips"].([]any); ok && len(values) > 0 {
+		allowedIPs = joinList(values)
+	}
+	setKey(peer, "AllowedIPs", allowedIPs)
+
+	return cfg, nil
+}
+
+// amneziaDNS lists the DNS servers of an exported configuration
+func amneziaDNS(doc map[string]any) []string {
+	var dns []string
+	for _, key := range []string{"dns1", "dns2"} {
+		if value := amneziaString(doc, key); value != "" {
+			dns = append(dns, value)
+		}
+	}
+	return dns
+}
+
+// amneziaString returns the value of key in m as a string, the Amnezia client
+// writing numbers as strings or JSON numbers depending on its version
+func amneziaString(m map[string]any, key string) string {
+	switch value := m[key].(type) {
+	case string:
+		return strings.TrimSpace(value)
+	case json.Number:
+		return value.String()
+	default:
+		return ""
+	}
+}
+
+// amneziaDeviceName derives the name of a device imported from a vpn:// link from the host
+// of its endpoint, keeping only the characters valid in an [Interface.<name>] section
+func amneziaDeviceName(device *DeviceConfig) string {
+	if len(device.Peers) == 0 || device.Peers[0].Endpoint == nil {
+		return "amnezia"
+	}
+	host, _, err := net.SplitHostPort(*device.Peers[0].Endpoint)
+	if err != nil {
+		host = *device.Peers[0].Endpoint
+	}
+	name := strings.Trim(strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(host)), "-")
+	if name == "" {
+		return "amnezia"
+	}
+	return name
+}
@@ -0,0 +1,340 @@
+package wireproxy
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// proxyRealm is the realm of the proxy authentication challenges
+	proxyRealm = "Proxy"
+	// digestNonceLifetime is how long a Digest nonce is accepted
+	digestNonceLifetime = 5 * time.Minute
+	// authMaxFailures is the number of failed authentications after which a client is locked out
+	authMaxFailures = 5
+	// authLockoutDuration is how long a client is locked out, and how long its failures are remembered
+	authLockoutDuration = time.Minute
+)
+
+var (
+	errNoCredentials   = errors.New(http.StatusText(http.StatusProxyAuthRequired))
+	errStaleNonce      = errors.New("stale digest nonce")
+	errTooManyFailures = errors.New("too many failed authentications")
+	errNotMatching     = errors.New("username and password not matching")
+	errInvalidNonce    = errors.New("invalid digest nonce")
+)
+
+// digestSecrets is implemented by the credentials knowing the cleartext passwords the Digest scheme needs
+type digestSecrets interface {
+	// digestAvailable reports whether some user can authenticate with the Digest scheme
+	digestAvailable() bool
+	password(username string) (string, bool)
+}
+
+func (c proxyCredentials) digestAvailable() bool {
+	return c.static != nil
+}
+
+func (c proxyCredentials) password(username string) (string, bool) {
+	if c.static == nil || subtle.ConstantTimeCompare([]byte(c.static.username), []byte(username)) != 1 {
+		return "", false
+	}
+	return c.static.password, true
+}
+
+// digestAuth issues and checks the nonces of the Digest scheme, which are signed
+// timestamps followed by random bytes, so that clients challenged in the same second
+// get different nonces. To prevent replays, the highest nonce count accepted with every
+// nonce is remembered until the nonce expires.
+type digestAuth struct {
+	once sync.Once
+	key  []byte
+
+	lock sync.Mutex
+	used map[string]*digestNonceUse
+}
+
+// digestNonceUse is the highest nonce count accepted with a nonce, and when the nonce expires
+type digestNonceUse struct {
+	count   uint64
+	expires time.Time
+}
+
+func (d *digestAuth) init() {
+	d.once.Do(func() {
+		d.key = make([]byte, 32)
+		_, _ = rand.Read(d.key)
+	})
+}
+
+// nonce returns a new nonce
+func (d *digestAuth) nonce() string {
+	d.init()
+	data := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Unix()))
+	data = append(data, make([]byte, 16)...)
+	_, _ = rand.Read(data[8:])
+	mac := hmac.New(sha256.New, d.key)
+	mac.Write(data)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(data)[:8+16+16])
+}
+
+// checkNonce checks that nonce was issued by d, returning when it expires.
+// errStaleNonce means it already expired.
+func (d *digestAuth) checkNonce(nonce string) (time.Time, error) {
+	d.init()
+	data, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(data) != 8+16+16 {
+		return time.Time{}, errInvalidNonce
+	}
+	mac := hmac.New(sha256.New, d.key)
+	mac.Write(data[:8+16])
+	if !hmac.Equal(mac.Sum(nil)[:16], data[8+16:]) {
+		return time.Time{}, errInvalidNonce
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint64(data[:8])), 0).Add(digestNonceLifetime)
+	if time.Now().After(expires) {
+		return time.Time{}, errStaleNonce
+	}
+	return expires, nil
+}
+
+// use records that nonce was used with count, which must be higher than the counts it was
+// used with before. Without qop the count is 0, so that such a nonce can only be used once.
+// A replayed nonce is reported as stale, the client then retrying with a new one.
+func (d *digestAuth) use(nonce string, count uint64, expires time.Time) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.used == nil {
+		d.used = make(map[string]*digestNonceUse)
+	}
+
+	if used, ok := d.used[nonce]; ok {
+		if count <= used.count {
+			return errStaleNonce
+		}
+		used.count = count
+		return nil
+	}
+
+	// Forget the expired nonces, so that the map does not grow forever
+	now := time.Now()
+	for nonce, used := range d.used {
+		if now.After(used.expires) {
+			delete(d.used, nonce)
+		}
+	}
+	d.used[nonce] = &digestNonceUse{count: count, expires: expires}
+	return nil
+}
+
+// challenges returns the Proxy-Authenticate values offered to a client, stale telling
+// the client that its Digest nonce expired
+func (d *digestAuth) challenges(digest, stale bool) []string {
+	challenges := []string{`Basic realm="` + proxyRealm + `"`}
+	if digest {
+		nonce := d.nonce()
+		suffix := ""
+		if stale {
+			suffix = ", stale=true"
+		}
+		challenges = append(challenges,
+			`Digest realm="`+proxyRealm+`", qop="auth", algorithm=SHA-256, nonce="`+nonce+`"`+suffix,
+			`Digest realm="`+proxyRealm+`", qop="auth", algorithm=MD5, nonce="`+nonce+`"`+suffix,
+		)
+	}
+	return challenges
+}
+
+// verify checks the parameters of a Digest authorization for a request with method and uri,
+// returning the authenticated user
+func (d *digestAuth) verify(params map[string]string, method, uri string, secrets digestSecrets) (string, error) {
+	expires, err := d.checkNonce(params["nonce"])
+	if err != nil {
+		return "", err
+	}
+	if params["realm"] != proxyRealm {
+		return "", errors.New("invalid digest realm")
+	}
+	if params["uri"] != uri {
+		return "", errors.New("digest uri does not match the request")
+	}
+
+	var newHash func() hash.Hash
+	switch strings.ToUpper(params["algorithm"]) {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", errors.New("unsupported digest algorithm: " + params["algorithm"])
+	}
+	digest := func(values ...string) string {
+		h := newHash()
+		h.Write([]byte(strings.Join(values, ":")))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+
+	username := params["username"]
+	password, ok := secrets.password(username)
+	if !ok {
+		return "", errNotMatching
+	}
+	ha1 := digest(username, proxyRealm, password)
+	ha2 := digest(method, uri)
+
+	var expected string
+	var count uint64
+	switch params["qop"] {
+	case "auth":
+		count, err = strconv.ParseUint(params["nc"], 16, 32)
+		if err != nil || count == 0 {
+			return "", errors.New("invalid digest nonce count")
+		}
+		expected = digest(ha1, params["nonce"], params["nc"], params["cnonce"], "auth", ha2)
+	case "":
+		expected = digest(ha1, params["nonce"], ha2)
+	default:
+		return "", errors.New("unsupported digest qop: " + params["qop"])
+	}
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(params["response"]))) != 1 {
+		return "", errNotMatching
+	}
+	// The nonce count is only recorded once the response is verified, so that it cannot be forged
+	if err := d.use(params["nonce"], count, expires); err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+// parseAuthParams parses the comma separated key=value parameters of an authorization,
+// whose values may be quoted
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params
+		}
+
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return params
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " \t")
+
+		var value strings.Builder
+		if strings.HasPrefix(rest, `"`) {
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				value.WriteByte(rest[i])
+			}
+			s = rest[min(i+1, len(rest)):]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value.WriteString(strings.TrimSpace(rest[:end]))
+			s = rest[end:]
+		}
+		params[key] = value.String()
+	}
+}
+
+// authLockout counts the failed authentications of every client address, locking out
+// the clients failing authMaxFailures times in a row
+type authLockout struct {
+	lock     sync.Mutex
+	failures map[netip.Addr]*authFailures
+}
+
+type authFailures struct {
+	count int
+	last  time.Time
+}
+
+// locked reports whether client is locked out. The clients without a valid address,
+// connected otherwise than over TCP, are never locked out since they cannot be told apart.
+func (l *authLockout) locked(client netip.Addr) bool {
+	if !client.IsValid() {
+		return false
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	failures, ok := l.failures[client]
+	if !ok {
+		return false
+	}
+	if time.Since(failures.last) > authLockoutDuration {
+		delete(l.failures, client)
+		return false
+	}
+	return failures.count >= authMaxFailures
+}
+
+// fail records a failed authentication of client, reporting whether it is now locked out
+func (l *authLockout) fail(client netip.Addr) bool {
+	if !client.IsValid() {
+		return false
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.failures == nil {
+		l.failures = make(map[netip.Addr]*authFailures)
+	}
+
+	now := time.Now()
+	failures, ok := l.failures[client]
+	if !ok || now.Sub(failures.last) > authLockoutDuration {
+		// Forget the clients that stopped failing, so that the map does not grow forever
+		for addr, failures := range l.failures {
+			if now.Sub(failures.last) > authLockoutDuration {
+				delete(l.failures, addr)
+			}
+		}
+		failures = &authFailures{}
+		l.failures[client] = failures
+	}
+	failures.count++
+	failures.last = now
+	return failures.count >= authMaxFailures
+}
+
+// succeed forgets the failed authentications of client
+func (l *authLockout) succeed(client netip.Addr) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.failures, client)
+}
+
+// validate checks the username and password sent by client with checker, counting the
+// failures. The credentials of a locked out client are not checked.
+func (l *authLockout) validate(checker credentialChecker, client netip.Addr, username, password string) error {
+	if l.locked(client) {
+		return errTooManyFailures
+	}
+	if !checker.Valid(username, password) {
+		l.fail(client)
+		return errNotMatching
+	}
+	l.succeed(client)
+	return nil
+}
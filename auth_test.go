@@ -0,0 +1,161 @@
+package wireproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+func TestHTTPProxyAuthentication(t *testing.T) {
+	credentials, err := newProxyCredentials(context.Background(), "peter", "secret", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &HTTPServer{
+		auth:         credentials,
+		logger:       device.NewLogger(device.LogLevelSilent, ""),
+		authRequired: true,
+		lockout:      &authLockout{},
+	}
+	client := netip.MustParseAddr("192.0.2.1")
+
+	request := func(authorization string) *http.Request {
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(
+			"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nProxy-Authorization: " + authorization + "\r\n\r\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+	basic := func(username, password string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+
+	_, code, err := server.authenticate(request(""), client)
+	if code != http.StatusProxyAuthRequired || err != errNoCredentials {
+		t.Fatalf("unexpected result without credentials: %d %v", code, err)
+	}
+	resp := responseWith(request(""), code)
+	server.challenge(resp, err)
+	challenges := resp.Header.Values("Proxy-Authenticate")
+	if len(challenges) != 3 || challenges[0] != `Basic realm="Proxy"` || !strings.HasPrefix(challenges[1], "Digest ") {
+		t.Fatalf("unexpected challenges: %v", challenges)
+	}
+
+	if user, _, err := server.authenticate(request(basic("peter", "secret")), client); err != nil || user != "peter" {
+		t.Errorf("Basic authentication failed: %v", err)
+	}
+
+	nonce := parseAuthParams(strings.TrimPrefix(challenges[1], "Digest "))["nonce"]
+	for i, algorithm := range []string{"MD5", "SHA-256"} {
+		// Both algorithms use the same nonce, with increasing nonce counts
+		nc := fmt.Sprintf("%08x", i+1)
+		digest := func(values ...string) string {
+			var sum []byte
+			if algorithm == "MD5" {
+				hash := md5.Sum([]byte(strings.Join(values, ":")))
+				sum = hash[:]
+			} else {
+				hash := sha256.Sum256([]byte(strings.Join(values, ":")))
+				sum = hash[:]
+			}
+			return hex.EncodeToString(sum)
+		}
+		response := digest(digest("peter", "Proxy", "secret"), nonce, nc, "abcdef", "auth", digest("CONNECT", "example.com:443"))
+		authorization := `Digest username="peter", realm="Proxy", nonce="` + nonce + `", uri="example.com:443", ` +
+			`algorithm=` + algorithm + `, qop=auth, nc=` + nc + `, cnonce="abcdef", response="` + response + `"`
+		if user, _, err := server.authenticate(request(authorization), client); err != nil || user != "peter" {
+			t.Errorf("Digest %s authentication failed: %v", algorithm, err)
+		}
+		if _, code, err := server.authenticate(request(authorization), client); code != http.StatusProxyAuthRequired || err != errStaleNonce {
+			t.Errorf("Digest %s authentication replayed: %d %v", algorithm, code, err)
+		}
+		wrongURI := strings.Replace(authorization, `uri="example.com:443"`, `uri="example.org:443"`, 1)
+		if _, code, err := server.authenticate(request(wrongURI), client); code != http.StatusProxyAuthRequired || err == nil {
+			t.Errorf("Digest %s authentication accepted for another uri", algorithm)
+		}
+	}
+
+	for _, authorization := range []string{
+		basic("peter", "wrong"),
+		"Basic !!!",
+		"Basic " + base64.StdEncoding.EncodeToString([]byte("peter")),
+		"Bearer " + base64.StdEncoding.EncodeToString([]byte("peter:secret")),
+	} {
+		if _, code, err := server.authenticate(request(authorization), client); code != http.StatusProxyAuthRequired || err == nil {
+			t.Errorf("unexpected result for %q: %d %v", authorization, code, err)
+		}
+	}
+
+	// The last failure with the wrong uri and the four above lock the client out
+	if _, code, _ := server.authenticate(request(basic("peter", "secret")), client); code != http.StatusTooManyRequests {
+		t.Errorf("client not locked out: %d", code)
+	}
+	if _, _, err := server.authenticate(request(basic("peter", "secret")), netip.MustParseAddr("192.0.2.2")); err != nil {
+		t.Errorf("another client locked out: %v", err)
+	}
+
+	// Clients without an address, like those connected over a unix socket, share no lockout
+	for i := 0; i < authMaxFailures; i++ {
+		_, _, _ = server.authenticate(request(basic("peter", "wrong")), netip.Addr{})
+	}
+	if _, _, err := server.authenticate(request(basic("peter", "secret")), netip.Addr{}); err != nil {
+		t.Errorf("client without an address locked out: %v", err)
+	}
+}
+
+func TestDigestNonceSameSecond(t *testing.T) {
+	credentials, err := newProxyCredentials(context.Background(), "peter", "secret", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &HTTPServer{
+		auth:         credentials,
+		logger:       device.NewLogger(device.LogLevelSilent, ""),
+		authRequired: true,
+		lockout:      &authLockout{},
+	}
+
+	// Two clients are challenged within the same second, each then using its nonce once
+	var nonces []string
+	for len(nonces) < 2 {
+		start := time.Now().Unix()
+		nonces = []string{server.digest.nonce(), server.digest.nonce()}
+		if time.Now().Unix() != start {
+			nonces = nil
+		}
+	}
+	if nonces[0] == nonces[1] {
+		t.Fatal("nonces issued in the same second are equal")
+	}
+
+	for i, nonce := range nonces {
+		digest := func(values ...string) string {
+			hash := md5.Sum([]byte(strings.Join(values, ":")))
+			return hex.EncodeToString(hash[:])
+		}
+		response := digest(digest("peter", "Proxy", "secret"), nonce, "00000001", "abcdef", "auth", digest("CONNECT", "example.com:443"))
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(
+			"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nProxy-Authorization: " +
+				`Digest username="peter", realm="Proxy", nonce="` + nonce + `", uri="example.com:443", ` +
+				`qop=auth, nc=00000001, cnonce="abcdef", response="` + response + `"` + "\r\n\r\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := netip.AddrFrom4([4]byte{192, 0, 2, byte(i + 1)})
+		if user, _, err := server.authenticate(req, client); err != nil || user != "peter" {
+			t.Errorf("Digest authentication of client %d failed: %v", i+1, err)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package wireproxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Protocols the I1 packet of a generated parameter set can imitate
+const (
+	MimicQUIC = "quic"
+	MimicDNS  = "dns"
+	MimicSIP  = "sip"
+)
+
+// mimicDomains are the names used by the imitated DNS and SIP packets
+var mimicDomains = []string{
+	"www.google.com", "cloudflare.com", "www.microsoft.com", "www.apple.com", "yandex.ru", "www.bing.com",
+}
+
+// ASecGenerateOptions tunes GenerateASecConfig
+type ASecGenerateOptions struct {
+	// HeaderRanges generates min-max ranges for H1-H4 instead of single values,
+	// which older AmneziaWG versions do not understand
+	HeaderRanges bool
+	// Mimic is the protocol imitated by the I1 packet, MimicQUIC, MimicDNS or MimicSIP.
+	// No I1 packet is generated when empty.
+	Mimic string
+}
+
+// GenerateASecConfig returns a random set of AWG obfuscation parameters satisfying ValidateASecConfig
+func GenerateASecConfig(options ASecGenerateOptions) (*ASecConfigType, error) {
+	config := &ASecConfigType{}
+
+	config.junkPacketCount = randomInt(3, 10)
+	config.junkPacketMinSize = randomInt(10, 100)
+	config.junkPacketMaxSize = randomInt(config.junkPacketMinSize+50, 1000)
+
+	// S1 + 148 = S2 + 92 and the S3 collisions are rare enough to retry
+	for {
+		config.initPacketJunkSize = randomInt(15, 150)
+		config.responsePacketJunkSize = randomInt(15, 150)
+		config.cookieReplyPacketJunkSize = randomInt(15, 150)
+		config.transportPacketJunkSize = randomInt(1, 32)
+		if ValidateASecConfig(config) == nil {
+			break
+		}
+	}
+
+	headers := generateMagicHeaders(options.HeaderRanges)
+	config.initPacketMagicHeader = headers[0]
+	config.responsePacketMagicHeader = headers[1]
+	config.underloadPacketMagicHeader = headers[2]
+	config.transportPacketMagicHeader = headers[3]
+
+	if options.Mimic != "" {
+		packet, err := mimicPacket(options.Mimic)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateObfSpec("I1", packet); err != nil {
+			return nil, err
+		}
+		config.i1 = &packet
+	}
+
+	if err := ValidateASecConfig(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// MarshalClientINI writes the parameters as the [Interface] section of a client configuration
+func (c *ASecConfigType) MarshalClientINI() []byte {
+	return c.marshalInterface(true)
+}
+
+// MarshalServerINI writes the parameters as the [Interface] section of a server configuration,
+// leaving out the I1-I5 packets only sent by the client
+func (c *ASecConfigType) MarshalServerINI() []byte {
+	return c.marshalInterface(false)
+}
+
+func (c *ASecConfigType) marshalInterface(packets bool) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("[Interface]\n")
+	for _, pair := range c.keys() {
+		if !packets && strings.HasPrefix(pair[0], "I") {
+			continue
+		}
+		writeWGQuickKey(&buf, pair[0], pair[1])
+	}
+	return buf.Bytes()
+}
+
+// generateMagicHeaders picks the H1-H4 values in four disjoint bands above the standard
+// message types, in a random order
+func generateMagicHeaders(ranges bool) [4]string {
+	const first, last = 5, 1<<31 - 1
+	const band = (last - first) / 4
+
+	var headers [4]string
+	order := randomPermutation(4)
+	for i := range headers {
+		low := first + order[i]*band
+		start := randomInt(low, low+band/2)
+		if ranges {
+			headers[i] = fmt.Sprintf("%d-%d", start, randomInt(start+1, low+band-1))
+		} else {
+			headers[i] = fmt.Sprint(start)
+		}
+	}
+	return headers
+}
+
+// mimicPacket returns an I1 packet specification looking like the first packet of protocol
+func mimicPacket(protocol string) (string, error) {
+	switch strings.ToLower(protocol) {
+	case MimicQUIC:
+		// Initial packet of QUIC v1 with an 8 bytes destination connection ID, no source
+		// connection ID nor token, and a 1182 bytes payload, padding the datagram to 1200 bytes
+		return "<b 0xc30000000108><r 8><b 0x0000449e><r 1182>", nil
+	case MimicDNS:
+		// Recursive query for the A record of a well-known domain
+		var query bytes.Buffer
+		query.Write([]byte{0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		for _, label := range strings.Split(randomChoice(mimicDomains), ".") {
+			query.WriteByte(byte(len(label)))
+			query.WriteString(label)
+		}
+		query.Write([]byte{0x00, 0x00, 0x01, 0x00, 0x01})
+		return "<r 2><b 0x" + hex.EncodeToString(query.Bytes()) + ">", nil
+	case MimicSIP:
+		// OPTIONS request used as a keepalive by SIP phones
+		domain := randomChoice(mimicDomains)
+		text := func(s string) string { return "<b 0x" + hex.EncodeToString([]byte(s)) + ">" }
+		return text("OPTIONS sip:"+domain+" SIP/2.0\r\nVia: SIP/2.0/UDP "+domain+";branch=z9hG4bK") +
+			"<rc 12>" + text("\r\nMax-Forwards: 70\r\nCall-ID: ") +
+			"<rc 16>" + text("\r\nCSeq: 1 OPTIONS\r\nContent-Length: 0\r\n\r\n"), nil
+	default:
+		return "", errors.New("unknown protocol to mimic: " + protocol)
+	}
+}
+
+// randomInt returns a uniformly distributed number in [min, max]
+func randomInt(min, max int) int {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max-min+1)))
+	if err != nil {
+		panic(err)
+	}
+	return min + int(n.Int64())
+}
+
+func randomPermutation(n int) []int {
+	perm := make([]int, n)
+	for i := range perm {
+		j := randomInt(0, i)
+		perm[i] = perm[j]
+		perm[j] = i
+	}
+	return perm
+}
+
+func randomChoice(values []string) string {
+	return values[randomInt(0, len(values)-1)]
+}
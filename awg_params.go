@@ -0,0 +1,156 @@
+package wireproxy
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// magicHeader is the inclusive range of message types an H1-H4 field stands for
+type magicHeader struct {
+	start uint32
+	end   uint32
+}
+
+// parseMagicHeader parses an H1-H4 value, a single message type or a min-max range
+func parseMagicHeader(field, spec string) (magicHeader, error) {
+	startStr, endStr, isRange := strings.Cut(strings.TrimSpace(spec), "-")
+
+	start, err := strconv.ParseUint(strings.TrimSpace(startStr), 10, 32)
+	if err != nil {
+		return magicHeader{}, fmt.Errorf("value of the %s field must be a number or a min-max range: %s", field, spec)
+	}
+	end := start
+	if isRange {
+		end, err = strconv.ParseUint(strings.TrimSpace(endStr), 10, 32)
+		if err != nil {
+			return magicHeader{}, fmt.Errorf("value of the %s field must be a number or a min-max range: %s", field, spec)
+		}
+		if end < start {
+			return magicHeader{}, fmt.Errorf("range of the %s field must not end before it starts: %s", field, spec)
+		}
+	}
+
+	return magicHeader{start: uint32(start), end: uint32(end)}, nil
+}
+
+// String returns the header in the form the device expects, start-end for a range
+func (h magicHeader) String() string {
+	if h.start == h.end {
+		return strconv.FormatUint(uint64(h.start), 10)
+	}
+	return strconv.FormatUint(uint64(h.start), 10) + "-" + strconv.FormatUint(uint64(h.end), 10)
+}
+
+func (h magicHeader) overlaps(other magicHeader) bool {
+	return h.start <= other.end && other.start <= h.end
+}
+
+// validateMagicHeaders checks that the H1-H4 ranges are disjoint and that none of them
+// includes the standard WireGuard message type of another, which is what an unset
+// header falls back to
+func validateMagicHeaders(specs [4]string) error {
+	var headers [4]*magicHeader
+	for i, spec := range specs {
+		if spec == "" {
+			continue
+		}
+		header, err := parseMagicHeader("H"+strconv.Itoa(i+1), spec)
+		if err != nil {
+			return err
+		}
+		headers[i] = &header
+	}
+
+	for i, header := range headers {
+		for j := i + 1; j < len(headers); j++ {
+			if header == nil || headers[j] == nil || !header.overlaps(*headers[j]) {
+				continue
+			}
+			if header.start == header.end && headers[j].start == headers[j].end {
+				return errors.New("values of the H1-H4 fields must be unique")
+			}
+			return fmt.Errorf("ranges of the H%d and H%d fields must not overlap", i+1, j+1)
+		}
+	}
+
+	for i, header := range headers {
+		if header == nil {
+			continue
+		}
+		for messageType := uint32(1); messageType <= 4; messageType++ {
+			if messageType != uint32(i+1) && header.overlaps(magicHeader{messageType, messageType}) {
+				return fmt.Errorf("value of the H%d field must not include the WireGuard message type %d", i+1, messageType)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateObfSpec checks the tags of an I1-I5 packet specification, such as
+// `<b 0xf6ab3267fa><r 16><t>`
+func validateObfSpec(field, spec string) error {
+	remaining := spec
+	for {
+		remaining = strings.TrimSpace(remaining)
+		if remaining == "" {
+			return nil
+		}
+		if remaining[0] != '<' {
+			return fmt.Errorf("value of the %s field has unexpected text outside of a tag: %s", field, remaining)
+		}
+
+		end := strings.IndexByte(remaining, '>')
+		if end == -1 {
+			return fmt.Errorf("value of the %s field is missing the closing > of %s", field, remaining)
+		}
+		tag := remaining[:end+1]
+		remaining = remaining[end+1:]
+
+		if err := validateObfTag(strings.Fields(tag[1 : len(tag)-1])); err != nil {
+			return fmt.Errorf("value of the %s field has an invalid tag %s: %w", field, tag, err)
+		}
+	}
+}
+
+func validateObfTag(parts []string) error {
+	if len(parts) == 0 {
+		return errors.New("empty tag")
+	}
+	if len(parts) > 2 {
+		return errors.New("too many arguments")
+	}
+
+	name, arg := parts[0], ""
+	if len(parts) == 2 {
+		arg = parts[1]
+	}
+
+	switch name {
+	case "b":
+		data := strings.TrimPrefix(arg, "0x")
+		if data == "" {
+			return errors.New("bytes expected as hexadecimal")
+		}
+		if _, err := hex.DecodeString(data); err != nil {
+			return errors.New("bytes expected as hexadecimal with an even number of digits")
+		}
+	case "r", "rc", "rd", "dz":
+		length, err := strconv.Atoi(arg)
+		if err != nil || length <= 0 {
+			return errors.New("positive length expected")
+		}
+	case "t", "d", "ds":
+		if arg != "" {
+			return errors.New("no argument expected")
+		}
+	case "c":
+		return errors.New("counter tags are not supported")
+	default:
+		return errors.New("unknown tag")
+	}
+	return nil
+}
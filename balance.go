@@ -0,0 +1,153 @@
+package wireproxy
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+const (
+	// BalanceRoundRobin hands new connections to the tunnels in turn
+	BalanceRoundRobin = "round-robin"
+	// BalanceLeastConn hands new connections to the tunnel with the fewest open ones
+	BalanceLeastConn = "least-conn"
+	// BalanceWeighted hands new connections to the tunnels in proportion to their weight
+	BalanceWeighted = "weighted"
+)
+
+// balancer spreads the connections of a routine across its tunnels.
+// Tunnels that are not Healthy are skipped as long as another one is.
+type balancer struct {
+	strategy string
+	tunnels  []*VirtualTun
+	weights  []int
+
+	lock    sync.Mutex
+	next    int
+	conns   []int
+	current []int
+}
+
+func (s *TunnelSelection) tunnelNames() []string {
+	return s.Devices
+}
+
+// newBalancer looks up the tunnels of selection, d itself being used when none is selected
+func (d *VirtualTun) newBalancer(selection TunnelSelection) (*balancer, error) {
+	b := &balancer{
+		strategy: selection.Balance,
+		weights:  selection.Weights,
+	}
+
+	for _, name := range selection.Devices {
+		tunnel, err := d.Tunnel(name)
+		if err != nil {
+			return nil, err
+		}
+		b.tunnels = append(b.tunnels, tunnel)
+	}
+	if len(b.tunnels) == 0 {
+		b.tunnels = []*VirtualTun{d}
+	}
+
+	b.conns = make([]int, len(b.tunnels))
+	b.current = make([]int, len(b.tunnels))
+	return b, nil
+}
+
+// pick returns the index of the tunnel the next connection should use. The connection is
+// counted as open on that tunnel until release is called, so that concurrent picks see it.
+func (b *balancer) pick() int {
+	candidates := make([]int, 0, len(b.tunnels))
+	if len(b.tunnels) > 1 {
+		for i, tunnel := range b.tunnels {
+			if tunnel.Healthy() {
+				candidates = append(candidates, i)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		for i := range b.tunnels {
+			candidates = append(candidates, i)
+		}
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	i := b.choose(candidates)
+	b.conns[i]++
+	return i
+}
+
+// choose returns the candidate picked by the strategy of the balancer, b.lock being held
+func (b *balancer) choose(candidates []int) int {
+	switch b.strategy {
+	case BalanceLeastConn:
+		best := candidates[0]
+		for _, i := range candidates[1:] {
+			if b.conns[i] < b.conns[best] {
+				best = i
+			}
+		}
+		return best
+	case BalanceWeighted:
+		// Smooth weighted round-robin, as done by nginx
+		total := 0
+		best := candidates[0]
+		for _, i := range candidates {
+			b.current[i] += b.weights[i]
+			total += b.weights[i]
+			if b.current[i] > b.current[best] {
+				best = i
+			}
+		}
+		b.current[best] -= total
+		return best
+	default:
+		i := candidates[b.next%len(candidates)]
+		b.next++
+		return i
+	}
+}
+
+// release gives back the connection picked on tunnel i
+func (b *balancer) release(i int) {
+	b.lock.Lock()
+	b.conns[i]--
+	b.lock.Unlock()
+}
+
+// reserve returns the tunnel the next connection of the balancer should use, and the
+// function giving it back once the connection ends
+func (b *balancer) reserve() (*VirtualTun, func()) {
+	i := b.pick()
+	return b.tunnels[i], func() {
+		b.release(i)
+	}
+}
+
+// dial connects to addr through the next tunnel of the balancer
+func (b *balancer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	tunnel, release := b.reserve()
+
+	conn, err := tunnel.dial(ctx, network, addr)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	return &balancedConn{Conn: conn, release: release}, nil
+}
+
+// balancedConn gives the connection back to its balancer once closed
+type balancedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *balancedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
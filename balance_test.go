@@ -0,0 +1,31 @@
+package wireproxy
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestBalancerPick(t *testing.T) {
+	tunnels := make([]*VirtualTun, 3)
+	for i := range tunnels {
+		tunnels[i] = &VirtualTun{Conf: &DeviceConfig{}, PingRecordLock: new(sync.Mutex)}
+	}
+
+	b := &balancer{strategy: BalanceRoundRobin, tunnels: tunnels, conns: make([]int, 3), current: make([]int, 3)}
+	for _, expected := range []int{0, 1, 2, 0} {
+		if i := b.pick(); i != expected {
+			t.Errorf("round-robin picked %d, expected %d", i, expected)
+		}
+	}
+
+	// Connections still being dialed count, so a burst is spread across the tunnels
+	b = &balancer{strategy: BalanceLeastConn, tunnels: tunnels, conns: make([]int, 3), current: make([]int, 3)}
+	picks := []int{b.pick(), b.pick(), b.pick()}
+	if picks[0] == picks[1] || picks[1] == picks[2] || picks[0] == picks[2] {
+		t.Errorf("least-conn picked %v", picks)
+	}
+	b.release(picks[1])
+	if i := b.pick(); i != picks[1] {
+		t.Errorf("least-conn picked %d after a release, expected %d", i, picks[1])
+	}
+}
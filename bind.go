@@ -0,0 +1,168 @@
+package wireproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// bindTimeout bounds the time a SOCKS5 BIND request waits for its inbound connection
+const bindTimeout = 2 * time.Minute
+
+var errDirectBind = errors.New("BIND is only supported through a tunnel")
+
+// bindTunnel returns the tunnel a BIND request expecting a connection from host:port listens
+// on, following the routing rules of d like dialRouted, and the function giving the tunnel
+// back to tunnels once the request ends
+func (d *VirtualTun) bindTunnel(tunnels *balancer, host string, port uint16) (*VirtualTun, func(), error) {
+	switch action := d.route(host, port); action {
+	case RouteTunnel:
+		tunnel, release := tunnels.reserve()
+		return tunnel, release, nil
+	case RouteDirect:
+		return nil, nil, errDirectBind
+	case RouteReject:
+		return nil, nil, errRejected
+	default:
+		tunnel, err := d.Tunnel(action)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tunnel, func() {}, nil
+	}
+}
+
+// listenAddress returns the address of the device to listen on for connections from
+// remote, preferring its family
+func (d *VirtualTun) listenAddress(remote netip.Addr) (netip.Addr, error) {
+	for _, addr := range d.Conf.Address {
+		if !remote.IsValid() || addr.Is4() == remote.Is4() {
+			return addr, nil
+		}
+	}
+	if len(d.Conf.Address) > 0 {
+		return d.Conf.Address[0], nil
+	}
+	return netip.Addr{}, errors.New("the device has no address to listen on")
+}
+
+// socks5Bind returns the handler of the SOCKS5 BIND command. It opens a temporary listener
+// on the netstack of a tunnel, reports its address to the client, and relays the first
+// connection coming from the host of the request, any host being accepted when it is unspecified.
+func socks5Bind(vt *VirtualTun, tunnels *balancer) func(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+	return func(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+		client, ok := writer.(net.Conn)
+		if !ok {
+			return errors.New("BIND requires a client connection")
+		}
+
+		host := request.DestAddr.FQDN
+		if host == "" {
+			host = request.DestAddr.IP.String()
+		}
+		tunnel, release, err := vt.bindTunnel(tunnels, host, uint16(request.DestAddr.Port))
+		if err != nil {
+			_ = socks5.SendReply(writer, statute.RepRuleFailure, nil)
+			return err
+		}
+		defer release()
+		tunnel = tunnel.Active()
+
+		remote, err := bindRemote(ctx, tunnel, request.DestAddr)
+		if err != nil {
+			_ = socks5.SendReply(writer, statute.RepHostUnreachable, nil)
+			return err
+		}
+
+		policy := vt.userPolicy(userFrom(ctx))
+		if policy != nil {
+			if err := policy.admit(remote.String(), uint16(request.DestAddr.Port)); err != nil {
+				_ = socks5.SendReply(writer, statute.RepRuleFailure, nil)
+				return err
+			}
+		}
+
+		conn, err := acceptBind(ctx, tunnel, remote, writer)
+		if err != nil {
+			if policy != nil {
+				policy.release()
+			}
+			return err
+		}
+		if policy != nil {
+			conn = policy.wrap(conn)
+		}
+		defer conn.Close()
+
+		if err := socks5.SendReply(writer, statute.RepSuccess, conn.RemoteAddr()); err != nil {
+			return err
+		}
+
+		// The request may have been read ahead of the data following it
+		relay(&peekedConn{Conn: client, reader: request.Reader}, conn)
+		return nil
+	}
+}
+
+// bindRemote returns the address of the host a BIND request expects a connection from,
+// resolving domain names through tunnel
+func bindRemote(ctx context.Context, tunnel *VirtualTun, dest *statute.AddrSpec) (netip.Addr, error) {
+	if dest.FQDN != "" {
+		_, ip, err := (&TUNResolver{vt: tunnel}).Resolve(ctx, dest.FQDN)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		dest = &statute.AddrSpec{IP: ip, Port: dest.Port}
+	}
+	remote, ok := netip.AddrFromSlice(dest.IP)
+	if !ok {
+		return netip.Addr{}, errors.New("invalid BIND address")
+	}
+	return remote.Unmap(), nil
+}
+
+// acceptBind listens on tunnel, sends the first reply of a BIND request to writer, and
+// waits for a connection from remote
+func acceptBind(ctx context.Context, tunnel *VirtualTun, remote netip.Addr, writer io.Writer) (net.Conn, error) {
+	local, err := tunnel.listenAddress(remote)
+	if err != nil {
+		_ = socks5.SendReply(writer, statute.RepServerFailure, nil)
+		return nil, err
+	}
+	listener, err := tunnel.currentNet().ListenTCP(net.TCPAddrFromAddrPort(netip.AddrPortFrom(local, 0)))
+	if err != nil {
+		_ = socks5.SendReply(writer, statute.RepServerFailure, nil)
+		return nil, err
+	}
+	defer listener.Close()
+
+	if err := socks5.SendReply(writer, statute.RepSuccess, listener.Addr()); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, bindTimeout)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			_ = socks5.SendReply(writer, statute.RepTTLExpired, nil)
+			return nil, err
+		}
+		if remote.IsUnspecified() || remoteAddr(conn) == remote {
+			return conn, nil
+		}
+		tunnel.Logger.Errorf("SOCKS5 BIND rejected connection from %s, expected %s", conn.RemoteAddr(), remote)
+		_ = conn.Close()
+	}
+}
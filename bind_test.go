@@ -0,0 +1,93 @@
+package wireproxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+func TestSocks5Bind(t *testing.T) {
+	address := netip.MustParseAddr("10.5.0.2")
+	vt := startTestDevice(t, address)
+	tunnels, err := vt.newBalancer(TunnelSelection{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bind := func(conn net.Conn) {
+		request := &socks5.Request{
+			DestAddr: &statute.AddrSpec{IP: net.IP(address.AsSlice()), Port: 21},
+			Reader:   conn,
+		}
+		_ = socks5Bind(vt, tunnels)(context.Background(), conn, request)
+	}
+
+	clientConn, done := startTestProxy(t, bind)
+
+	reply, err := statute.ParseReply(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Response != statute.RepSuccess || !reply.BndAddr.IP.Equal(net.IP(address.AsSlice())) || reply.BndAddr.Port == 0 {
+		t.Fatalf("unexpected first reply: %+v", reply)
+	}
+
+	inbound, err := vt.Tnet.DialTCP(net.TCPAddrFromAddrPort(netip.AddrPortFrom(address, uint16(reply.BndAddr.Port))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inbound.Close()
+
+	reply, err = statute.ParseReply(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Response != statute.RepSuccess || !reply.BndAddr.IP.Equal(net.IP(address.AsSlice())) {
+		t.Fatalf("unexpected second reply: %+v", reply)
+	}
+
+	if _, err := inbound.Write([]byte("220 ready\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(clientConn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "220 ready\r\n" {
+		t.Errorf("unexpected relayed data: %q", line)
+	}
+
+	// The tunnel is counted as used by the session until it ends
+	open := func() int {
+		tunnels.lock.Lock()
+		defer tunnels.lock.Unlock()
+		return tunnels.conns[0]
+	}
+	if open() != 1 {
+		t.Errorf("expected 1 open connection during the session, got %d", open())
+	}
+	_ = clientConn.Close()
+	_ = inbound.Close()
+	<-done
+	if open() != 0 {
+		t.Errorf("expected no open connection after the session, got %d", open())
+	}
+
+	// BIND follows the routing rules
+	vt.Rules = []*RouteRule{{Prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, Action: RouteReject}}
+	clientConn, _ = startTestProxy(t, bind)
+	reply, err = statute.ParseReply(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Response != statute.RepRuleFailure {
+		t.Errorf("unexpected reply to a rejected BIND: %+v", reply)
+	}
+	if open() != 0 {
+		t.Errorf("rejected BIND counted as open connection")
+	}
+}
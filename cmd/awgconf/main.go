@@ -0,0 +1,146 @@
+// Command awgconf converts AmneziaVPN configurations into wireproxy configuration files.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	wireproxy "github.com/wgtunnel/wireproxy-awg"
+)
+
+const usage = `Usage:
+  awgconf import <vpn://link | file | ->
+        convert an AmneziaVPN vpn:// link, or the JSON exported by the Amnezia
+        client, into a wireproxy configuration printed on the standard output
+  awgconf check <file>
+        strictly validate a wireproxy configuration file, reporting unknown
+        sections and keys and conflicting settings along with their line
+  awgconf generate [-ranges] [-mimic quic|dns|sip]
+        generate a random set of AmneziaWG obfuscation parameters, printed
+        as the [Interface] sections of the client and of the server
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(flag.CommandLine.Output(), usage) }
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch flag.Arg(0) {
+	case "import":
+		err = runImport(flag.Args()[1:])
+	case "check":
+		err = runCheck(flag.Args()[1:])
+	case "generate":
+		err = runGenerate(flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "awgconf:", err)
+		os.Exit(1)
+	}
+}
+
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(flags.Output(), usage) }
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	source, err := readSource(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	device, err := wireproxy.ParseAmneziaConfig(source)
+	if err != nil {
+		return err
+	}
+
+	conf := &wireproxy.Configuration{
+		Device:  device,
+		Devices: []*wireproxy.DeviceConfig{device},
+	}
+	data, err := conf.MarshalINI()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+func runCheck(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(flags.Output(), usage) }
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	diagnostics, err := wireproxy.ValidateConfig(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	for _, diagnostic := range diagnostics {
+		fmt.Println(diagnostic)
+	}
+	if len(diagnostics) > 0 {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func runGenerate(args []string) error {
+	var options wireproxy.ASecGenerateOptions
+	flags := flag.NewFlagSet("generate", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(flags.Output(), usage) }
+	flags.BoolVar(&options.HeaderRanges, "ranges", false, "generate min-max ranges for H1-H4")
+	flags.StringVar(&options.Mimic, "mimic", "", "protocol imitated by the I1 packet: quic, dns or sip")
+	_ = flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	config, err := wireproxy.GenerateASecConfig(options)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("# Client")
+	_, _ = os.Stdout.Write(config.MarshalClientINI())
+	fmt.Println()
+	fmt.Println("# Server")
+	_, err = os.Stdout.Write(config.MarshalServerINI())
+	return err
+}
+
+// readSource returns arg when it is a vpn:// link, and the content of the file it names otherwise.
+// "-" reads the standard input.
+func readSource(arg string) (string, error) {
+	if wireproxy.IsAmneziaLink(arg) {
+		return arg, nil
+	}
+
+	var data []byte
+	var err error
+	if arg == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(arg)
+	}
+	return strings.TrimSpace(string(data)), err
+}
@@ -8,7 +8,10 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 
 	"net/netip"
 
@@ -22,6 +25,11 @@ type PeerConfig struct {
 	Endpoint     *string
 	KeepAlive    int
 	AllowedIPs   []netip.Prefix
+	// hostname keeps the original endpoint host once it has been replaced by a resolved IP
+	hostname string
+	// candidates lists every resolved address of the endpoint, Endpoint being candidates[candidate]
+	candidates []netip.AddrPort
+	candidate  int
 }
 
 type ASecConfigType struct {
@@ -45,6 +53,7 @@ type ASecConfigType struct {
 
 // DeviceConfig contains the information to initiate a wireguard connection
 type DeviceConfig struct {
+	Name                  string
 	SecretKey             string
 	Address               []netip.Addr
 	Peers                 []PeerConfig
@@ -56,7 +65,17 @@ type DeviceConfig struct {
 	DomainBlockingEnabled bool
 	BlockedDomains        []string
 	CheckAliveInterval    int
+	RestartThreshold      int
+	RestartMaxBackoff     int
 	ASecConfig            *ASecConfigType
+	// OnUp, OnDown, OnHandshake and OnHealthChange are shell commands run on the events of the device
+	OnUp           []string
+	OnDown         []string
+	OnHandshake    []string
+	OnHealthChange []string
+
+	// endpointLock guards the Endpoint of Peers, switched between candidates while the device runs
+	endpointLock sync.Mutex
 }
 
 // DeviceSetting contains the parameters for setting up a tun interface
@@ -81,20 +100,120 @@ type TCPServerTunnelConfig struct {
 	Target     string
 }
 
+// TunnelSelection picks the tunnels a routine sends its connections through
+type TunnelSelection struct {
+	// Devices lists the named tunnels to use, the default tunnel being used when empty
+	Devices []string
+	// Balance is the strategy spreading new connections across Devices
+	Balance string
+	// Weights of Devices for the weighted strategy
+	Weights []int
+}
+
 type Socks5Config struct {
+	TunnelSelection
 	BindAddress string
 	Username    string
 	Password    string
+	// UsersFile is an htpasswd style file listing more users, reloaded when it changes
+	UsersFile string
+	// AllowFrom lists the source addresses allowed to connect, every address being allowed when empty
+	AllowFrom []netip.Prefix
 }
 
 type HTTPConfig struct {
+	TunnelSelection
+	BindAddress string
+	Username    string
+	Password    string
+	// UsersFile is an htpasswd style file listing more users, reloaded when it changes
+	UsersFile string
+	// AllowFrom lists the source addresses allowed to connect, every address being allowed when empty
+	AllowFrom []netip.Prefix
+	// CertFile and KeyFile make the proxy accept TLS connections
+	CertFile string
+	KeyFile  string
+	// ClientCAFile authenticates the clients by certificate, the common name being the user
+	ClientCAFile string
+}
+
+// MixedConfig is a proxy serving SOCKS4/4a, SOCKS5 and HTTP clients on the same BindAddress
+type MixedConfig struct {
+	TunnelSelection
 	BindAddress string
 	Username    string
 	Password    string
+	// UsersFile is an htpasswd style file listing more users, reloaded when it changes
+	UsersFile string
+	// AllowFrom lists the source addresses allowed to connect, every address being allowed when empty
+	AllowFrom []netip.Prefix
+}
+
+// TransparentTCPConfig is a transparent proxy accepting the TCP connections redirected to
+// BindAddress by iptables, and forwarding them to their original destination
+type TransparentTCPConfig struct {
+	TunnelSelection
+	BindAddress string
+	// AllowFrom lists the source addresses allowed to connect, every address being allowed when empty
+	AllowFrom []netip.Prefix
+	// TProxy accepts connections diverted by the TPROXY target, whose destination is the
+	// local address of the socket, instead of connections rewritten by REDIRECT
+	TProxy bool
+}
+
+// SNIProxyConfig is a proxy for the clients pointed at it by DNS, forwarding their
+// connections to the host name they ask for, read from the TLS server name or the HTTP
+// Host header, without terminating TLS
+type SNIProxyConfig struct {
+	TunnelSelection
+	BindAddress string
+	// AllowFrom lists the source addresses allowed to connect, every address being allowed when empty
+	AllowFrom []netip.Prefix
+	// Allowed holds the names and ports the clients may connect to
+	Allowed RouteRule
+	// TargetPort is the port connected to, the one the client connected to when 0
+	TargetPort uint16
+}
+
+// PACConfig describes the proxy auto-config file served to browsers
+type PACConfig struct {
+	// Host is the address the browsers reach the proxies at, the host of the request
+	// or of the BindAddress of the proxies being used when empty
+	Host string
+	// Domains and Prefixes are the destinations going through the proxies, every
+	// destination going through them when both are empty
+	Domains  []string
+	Prefixes []netip.Prefix
+}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	Start uint16
+	End   uint16
+}
+
+// RouteRule sends the proxied connections matching all of its conditions to Action,
+// which is the name of a tunnel, RouteTunnel, RouteDirect or RouteReject
+type RouteRule struct {
+	Domains  []string
+	Prefixes []netip.Prefix
+	Ports    []PortRange
+	Action   string
 }
 
 type Configuration struct {
-	Device   *DeviceConfig
+	// Device is the primary device, the same as Devices[0]
+	Device *DeviceConfig
+	// Devices lists every configured device by priority, the lower ones are used as failover
+	Devices []*DeviceConfig
+	// Tunnels holds the devices defined by [Interface.<name>] sections, selected with `Device = <name>`
+	Tunnels map[string]*DeviceConfig
+	// Rules are evaluated in order by the proxies to pick the egress of a connection
+	Rules []*RouteRule
+	// Users holds the policies of the proxy users defined by [User] sections, by name
+	Users map[string]*UserPolicy
+	// PAC is the proxy auto-config file served to browsers, nil when there is no [PAC] section
+	PAC      *PACConfig
 	Routines []RoutineSpawner
 }
 
@@ -103,19 +222,42 @@ func parseString(section *ini.Section, keyName string) (string, error) {
 	if key == nil {
 		return "", errors.New(keyName + " should not be empty")
 	}
-	value := key.String()
+	return resolveValue(keyName, key.String())
+}
+
+// resolveValue replaces a value starting with $ by the environment variable it references,
+// $$ escaping a literal $
+func resolveValue(keyName, value string) (string, error) {
 	if strings.HasPrefix(value, "$") {
 		if strings.HasPrefix(value, "$$") {
 			return strings.Replace(value, "$$", "$", 1), nil
 		}
-		var ok bool
-		value, ok = os.LookupEnv(strings.TrimPrefix(value, "$"))
+		resolved, ok := os.LookupEnv(strings.TrimPrefix(value, "$"))
 		if !ok {
-			return "", errors.New(keyName + " references unset environment variable " + key.String())
+			return "", errors.New(keyName + " references unset environment variable " + value)
 		}
-		return value, nil
+		return resolved, nil
 	}
-	return key.String(), nil
+	return value, nil
+}
+
+// parseList returns the comma separated list of keyName, the values of a repeated key
+// being joined into a single list
+func parseList(section *ini.Section, keyName string) (string, error) {
+	key, err := section.GetKey(keyName)
+	if err != nil {
+		return "", nil
+	}
+
+	var values []string
+	for _, value := range key.ValueWithShadows() {
+		value, err := resolveValue(keyName, value)
+		if err != nil {
+			return "", err
+		}
+		values = append(values, value)
+	}
+	return strings.Join(values, ","), nil
 }
 
 func parsePort(section *ini.Section, keyName string) (int, error) {
@@ -151,7 +293,7 @@ func parseBase64KeyToHex(section *ini.Section, keyName string) (string, error) {
 	}
 	result, err := encodeBase64ToHex(key)
 	if err != nil {
-		return result, err
+		return result, fmt.Errorf("%s: %w", keyName, err)
 	}
 
 	return result, nil
@@ -160,16 +302,16 @@ func parseBase64KeyToHex(section *ini.Section, keyName string) (string, error) {
 func encodeBase64ToHex(key string) (string, error) {
 	decoded, err := base64.StdEncoding.DecodeString(key)
 	if err != nil {
-		return "", errors.New("invalid base64 string: " + key)
+		return "", errors.New("invalid base64 string")
 	}
 	if len(decoded) != 32 {
-		return "", errors.New("key should be 32 bytes: " + key)
+		return "", errors.New("key should be 32 bytes")
 	}
 	return hex.EncodeToString(decoded), nil
 }
 
 func parseNetIP(section *ini.Section, keyName string) ([]netip.Addr, error) {
-	key, err := parseString(section, keyName)
+	key, err := parseList(section, keyName)
 	if err != nil {
 		if strings.Contains(err.Error(), "should not be empty") {
 			return []netip.Addr{}, nil
@@ -194,7 +336,7 @@ func parseNetIP(section *ini.Section, keyName string) ([]netip.Addr, error) {
 }
 
 func parseDNS(section *ini.Section, keyName string) ([]netip.Addr, []string, error) {
-	key, err := parseString(section, keyName)
+	key, err := parseList(section, keyName)
 	if err != nil {
 		if strings.Contains(err.Error(), "should not be empty") {
 			return []netip.Addr{}, []string{}, nil
@@ -220,7 +362,7 @@ func parseDNS(section *ini.Section, keyName string) ([]netip.Addr, []string, err
 }
 
 func parseStrings(section *ini.Section, keyName string) ([]string, error) {
-	key, err := parseString(section, keyName)
+	key, err := parseList(section, keyName)
 	if err != nil {
 		if strings.Contains(err.Error(), "should not be empty") {
 			return []string{}, nil
@@ -237,7 +379,7 @@ func parseStrings(section *ini.Section, keyName string) ([]string, error) {
 }
 
 func parseStringList(section *ini.Section, keyName string) ([]string, error) {
-	key, err := parseString(section, keyName)
+	key, err := parseList(section, keyName)
 	if err != nil {
 		if strings.Contains(err.Error(), "should not be empty") {
 			return []string{}, nil
@@ -257,8 +399,24 @@ func parseStringList(section *ini.Section, keyName string) ([]string, error) {
 	return strs, nil
 }
 
+// parseCommands returns every value of the repeatable key keyName, left as is for the shell
+func parseCommands(section *ini.Section, keyName string) []string {
+	key, err := section.GetKey(keyName)
+	if err != nil {
+		return nil
+	}
+
+	var commands []string
+	for _, command := range key.ValueWithShadows() {
+		if command = strings.TrimSpace(command); command != "" {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
 func parseCIDRNetIP(section *ini.Section, keyName string) ([]netip.Addr, error) {
-	key, err := parseString(section, keyName)
+	key, err := parseList(section, keyName)
 	if err != nil {
 		if strings.Contains(err.Error(), "should not be empty") {
 			return []netip.Addr{}, nil
@@ -289,8 +447,30 @@ func parseCIDRNetIP(section *ini.Section, keyName string) ([]netip.Addr, error)
 	return ips, nil
 }
 
+// parsePrefixes reads a list of CIDRs, a single address standing for itself
+func parsePrefixes(section *ini.Section, keyName string) ([]netip.Prefix, error) {
+	values, err := parseStringList(section, keyName)
+	if err != nil {
+		return nil, err
+	}
+
+	var prefixes []netip.Prefix
+	for _, value := range values {
+		if addr, err := netip.ParseAddr(value); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", keyName, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
 func parseAllowedIPs(section *ini.Section) ([]netip.Prefix, error) {
-	key, err := parseString(section, "AllowedIPs")
+	key, err := parseList(section, "AllowedIPs")
 	if err != nil {
 		if strings.Contains(err.Error(), "should not be empty") {
 			return []netip.Prefix{}, nil
@@ -321,8 +501,11 @@ func ParseInterface(cfg *ini.File, device *DeviceConfig) error {
 	if len(sections) != 1 || err != nil {
 		return errors.New("one and only one [Interface] is expected")
 	}
-	section := sections[0]
+	return parseInterfaceSection(sections[0], device)
+}
 
+// parseInterfaceSection extracts the information of a single [Interface] section into `device`
+func parseInterfaceSection(section *ini.Section, device *DeviceConfig) error {
 	address, err := parseCIDRNetIP(section, "Address")
 	if err != nil {
 		return err
@@ -330,11 +513,14 @@ func ParseInterface(cfg *ini.File, device *DeviceConfig) error {
 
 	device.Address = address
 
-	privKey, err := parseBase64KeyToHex(section, "PrivateKey")
+	privKey, err := parseSecret(section, "PrivateKey")
 	if err != nil {
 		return err
 	}
-	device.SecretKey = privKey
+	device.SecretKey, err = encodeBase64ToHex(privKey)
+	if err != nil {
+		return fmt.Errorf("PrivateKey: %w", err)
+	}
 
 	dnsIps, searchDomains, err := parseDNS(section, "DNS")
 	if err != nil {
@@ -388,15 +574,52 @@ func ParseInterface(cfg *ini.File, device *DeviceConfig) error {
 		if len(checkAlive) == 0 {
 			return errors.New("CheckAliveInterval is only valid when CheckAlive is set")
 		}
+		if value < 1 {
+			return errors.New("CheckAliveInterval must be at least 1")
+		}
 		device.CheckAliveInterval = value
 	}
 
+	if sectionKey, err := section.GetKey("RestartThreshold"); err == nil {
+		value, err := sectionKey.Int()
+		if err != nil {
+			return err
+		}
+		if len(checkAlive) == 0 {
+			return errors.New("RestartThreshold is only valid when CheckAlive is set")
+		}
+		if value < 0 {
+			return errors.New("RestartThreshold must be non-negative")
+		}
+		device.RestartThreshold = value
+	}
+
+	device.RestartMaxBackoff = 300
+	if sectionKey, err := section.GetKey("RestartMaxBackoff"); err == nil {
+		value, err := sectionKey.Int()
+		if err != nil {
+			return err
+		}
+		if device.RestartThreshold == 0 {
+			return errors.New("RestartMaxBackoff is only valid when RestartThreshold is set")
+		}
+		if value <= 0 {
+			return errors.New("RestartMaxBackoff must be positive")
+		}
+		device.RestartMaxBackoff = value
+	}
+
 	aSecConfig, err := ParseASecConfig(section)
 	if err != nil {
 		return err
 	}
 	device.ASecConfig = aSecConfig
 
+	device.OnUp = parseCommands(section, "OnUp")
+	device.OnDown = parseCommands(section, "OnDown")
+	device.OnHandshake = parseCommands(section, "OnHandshake")
+	device.OnHealthChange = parseCommands(section, "OnHealthChange")
+
 	return nil
 }
 
@@ -494,51 +717,78 @@ func ParseASecConfig(section *ini.Section) (*ASecConfigType, error) {
 	}
 
 	if sectionKey, err := section.GetKey("H1"); err == nil {
-		value := sectionKey.String()
+		header, err := parseMagicHeader("H1", sectionKey.String())
+		if err != nil {
+			return nil, err
+		}
 		initializeASecConfig()
-		aSecConfig.initPacketMagicHeader = value
+		aSecConfig.initPacketMagicHeader = header.String()
 	}
 
 	if sectionKey, err := section.GetKey("H2"); err == nil {
-		value := sectionKey.String()
+		header, err := parseMagicHeader("H2", sectionKey.String())
+		if err != nil {
+			return nil, err
+		}
 		initializeASecConfig()
-		aSecConfig.responsePacketMagicHeader = value
+		aSecConfig.responsePacketMagicHeader = header.String()
 	}
 
 	if sectionKey, err := section.GetKey("H3"); err == nil {
-		value := sectionKey.String()
+		header, err := parseMagicHeader("H3", sectionKey.String())
+		if err != nil {
+			return nil, err
+		}
 		initializeASecConfig()
-		aSecConfig.underloadPacketMagicHeader = value
+		aSecConfig.underloadPacketMagicHeader = header.String()
 	}
 
 	if sectionKey, err := section.GetKey("H4"); err == nil {
-		value := sectionKey.String()
+		header, err := parseMagicHeader("H4", sectionKey.String())
+		if err != nil {
+			return nil, err
+		}
 		initializeASecConfig()
-		aSecConfig.transportPacketMagicHeader = value
+		aSecConfig.transportPacketMagicHeader = header.String()
 	}
 
 	if sectionKey, err := section.GetKey("I1"); err == nil {
 		value := sectionKey.String()
+		if err := validateObfSpec("I1", value); err != nil {
+			return nil, err
+		}
 		initializeASecConfig()
 		aSecConfig.i1 = &value
 	}
 	if sectionKey, err := section.GetKey("I2"); err == nil {
 		value := sectionKey.String()
+		if err := validateObfSpec("I2", value); err != nil {
+			return nil, err
+		}
 		initializeASecConfig()
 		aSecConfig.i2 = &value
 	}
 	if sectionKey, err := section.GetKey("I3"); err == nil {
 		value := sectionKey.String()
+		if err := validateObfSpec("I3", value); err != nil {
+			return nil, err
+		}
 		initializeASecConfig()
 		aSecConfig.i3 = &value
 	}
 	if sectionKey, err := section.GetKey("I4"); err == nil {
 		value := sectionKey.String()
+		if err := validateObfSpec("I4", value); err != nil {
+			return nil, err
+		}
 		initializeASecConfig()
 		aSecConfig.i4 = &value
 	}
 	if sectionKey, err := section.GetKey("I5"); err == nil {
 		value := sectionKey.String()
+		if err := validateObfSpec("I5", value); err != nil {
+			return nil, err
+		}
 		initializeASecConfig()
 		aSecConfig.i5 = &value
 	}
@@ -579,7 +829,13 @@ func ValidateASecConfig(config *ASecConfigType) error {
 			"value of the field S2 + message response size (92) must not equal S3 + cookie reply size (64)",
 		)
 	}
-	return nil
+
+	return validateMagicHeaders([4]string{
+		config.initPacketMagicHeader,
+		config.responsePacketMagicHeader,
+		config.underloadPacketMagicHeader,
+		config.transportPacketMagicHeader,
+	})
 }
 
 // ParsePeers parses the [Peer] section and extract the information into `peers`
@@ -589,12 +845,16 @@ func ParsePeers(cfg *ini.File, peers *[]PeerConfig) error {
 		*peers = []PeerConfig{}
 		return nil
 	}
+	return parsePeerSections(sections, peers)
+}
 
+// parsePeerSections extracts the information of the given [Peer] sections into `peers`
+func parsePeerSections(sections []*ini.Section, peers *[]PeerConfig) error {
 	*peers = make([]PeerConfig, 0, len(sections))
 
 	for _, section := range sections {
 		peer := PeerConfig{
-			PreSharedKey: "0000000000000000000000000000000000000000000000000000000000000000",
+			PreSharedKey: zeroKey,
 			KeepAlive:    0,
 		}
 
@@ -604,12 +864,15 @@ func ParsePeers(cfg *ini.File, peers *[]PeerConfig) error {
 		}
 		peer.PublicKey = decoded
 
-		if sectionKey, err := section.GetKey("PreSharedKey"); err == nil {
-			value, err := encodeBase64ToHex(sectionKey.String())
+		if section.HasKey("PreSharedKey") || section.HasKey("PreSharedKeyFile") {
+			preSharedKey, err := parseSecret(section, "PreSharedKey")
 			if err != nil {
 				return err
 			}
-			peer.PreSharedKey = value
+			peer.PreSharedKey, err = encodeBase64ToHex(preSharedKey)
+			if err != nil {
+				return fmt.Errorf("PreSharedKey: %w", err)
+			}
 		}
 
 		if sectionKey, err := section.GetKey("Endpoint"); err == nil {
@@ -635,6 +898,21 @@ func ParsePeers(cfg *ini.File, peers *[]PeerConfig) error {
 	return nil
 }
 
+// parseUsersFile returns the UsersFile of a proxy, after checking that it can be loaded
+func parseUsersFile(section *ini.Section) (string, error) {
+	if !section.HasKey("UsersFile") {
+		return "", nil
+	}
+	path, err := parseString(section, "UsersFile")
+	if err != nil {
+		return "", err
+	}
+	if _, err := LoadUserStore(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
 func parseSocks5Config(section *ini.Section) (RoutineSpawner, error) {
 	config := &Socks5Config{}
 
@@ -647,12 +925,58 @@ func parseSocks5Config(section *ini.Section) (RoutineSpawner, error) {
 	username, _ := parseString(section, "Username")
 	config.Username = username
 
-	password, _ := parseString(section, "Password")
-	config.Password = password
+	config.Password, err = parseSecret(section, "Password")
+	if err != nil {
+		return nil, err
+	}
+
+	config.UsersFile, err = parseUsersFile(section)
+	if err != nil {
+		return nil, err
+	}
+
+	config.AllowFrom, err = parsePrefixes(section, "AllowFrom")
+	if err != nil {
+		return nil, err
+	}
+
+	config.TunnelSelection, err = parseTunnelSelection(section)
+	if err != nil {
+		return nil, err
+	}
 
 	return config, nil
 }
 
+// parseHTTPTLS reads the certificate files of an HTTPS proxy, checking that they can be loaded
+func parseHTTPTLS(section *ini.Section, config *HTTPConfig) error {
+	var err error
+	config.CertFile, err = parseString(section, "CertFile")
+	if err != nil {
+		return err
+	}
+	config.KeyFile, err = parseString(section, "KeyFile")
+	if err != nil {
+		return err
+	}
+	config.ClientCAFile, err = parseString(section, "ClientCAFile")
+	if err != nil {
+		return err
+	}
+
+	if config.CertFile == "" && config.KeyFile == "" {
+		if config.ClientCAFile != "" {
+			return errors.New("ClientCAFile requires CertFile and KeyFile")
+		}
+		return nil
+	}
+	if config.CertFile == "" || config.KeyFile == "" {
+		return errors.New("CertFile and KeyFile must be both set")
+	}
+	_, err = loadCertStore(config.CertFile, config.KeyFile, config.ClientCAFile)
+	return err
+}
+
 func parseHTTPConfig(section *ini.Section) (RoutineSpawner, error) {
 	config := &HTTPConfig{}
 
@@ -665,12 +989,389 @@ func parseHTTPConfig(section *ini.Section) (RoutineSpawner, error) {
 	username, _ := parseString(section, "Username")
 	config.Username = username
 
-	password, _ := parseString(section, "Password")
-	config.Password = password
+	config.Password, err = parseSecret(section, "Password")
+	if err != nil {
+		return nil, err
+	}
+
+	config.UsersFile, err = parseUsersFile(section)
+	if err != nil {
+		return nil, err
+	}
+
+	config.AllowFrom, err = parsePrefixes(section, "AllowFrom")
+	if err != nil {
+		return nil, err
+	}
+
+	err = parseHTTPTLS(section, config)
+	if err != nil {
+		return nil, err
+	}
+
+	config.TunnelSelection, err = parseTunnelSelection(section)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func parseTransparentTCPConfig(section *ini.Section) (RoutineSpawner, error) {
+	config := &TransparentTCPConfig{}
+
+	bindAddress, err := parseString(section, "BindAddress")
+	if err != nil {
+		return nil, err
+	}
+	config.BindAddress = bindAddress
+
+	config.AllowFrom, err = parsePrefixes(section, "AllowFrom")
+	if err != nil {
+		return nil, err
+	}
+
+	if sectionKey, err := section.GetKey("TProxy"); err == nil {
+		value, err := sectionKey.Bool()
+		if err != nil {
+			return nil, err
+		}
+		config.TProxy = value
+	}
+
+	config.TunnelSelection, err = parseTunnelSelection(section)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func parseSNIProxyConfig(section *ini.Section) (RoutineSpawner, error) {
+	config := &SNIProxyConfig{}
+
+	bindAddress, err := parseString(section, "BindAddress")
+	if err != nil {
+		return nil, err
+	}
+	config.BindAddress = bindAddress
+
+	config.AllowFrom, err = parsePrefixes(section, "AllowFrom")
+	if err != nil {
+		return nil, err
+	}
+
+	err = parseRouteConditions(section, &config.Allowed)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Allowed.Domains) == 0 && len(config.Allowed.Prefixes) == 0 {
+		return nil, errors.New("SNIProxy needs a Domain, CIDR or List of allowed names")
+	}
+
+	if sectionKey, err := section.GetKey("TargetPort"); err == nil {
+		port, err := strconv.ParseUint(sectionKey.String(), 10, 16)
+		if err != nil || port == 0 {
+			return nil, errors.New("invalid TargetPort: " + sectionKey.String())
+		}
+		config.TargetPort = uint16(port)
+	}
+
+	config.TunnelSelection, err = parseTunnelSelection(section)
+	if err != nil {
+		return nil, err
+	}
 
 	return config, nil
 }
 
+func parseMixedConfig(section *ini.Section) (RoutineSpawner, error) {
+	config := &MixedConfig{}
+
+	bindAddress, err := parseString(section, "BindAddress")
+	if err != nil {
+		return nil, err
+	}
+	config.BindAddress = bindAddress
+
+	username, _ := parseString(section, "Username")
+	config.Username = username
+
+	config.Password, err = parseSecret(section, "Password")
+	if err != nil {
+		return nil, err
+	}
+
+	config.UsersFile, err = parseUsersFile(section)
+	if err != nil {
+		return nil, err
+	}
+
+	config.AllowFrom, err = parsePrefixes(section, "AllowFrom")
+	if err != nil {
+		return nil, err
+	}
+
+	config.TunnelSelection, err = parseTunnelSelection(section)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func parsePortRanges(section *ini.Section, keyName string) ([]PortRange, error) {
+	values, err := parseStringList(section, keyName)
+	if err != nil {
+		return nil, err
+	}
+
+	ranges := make([]PortRange, 0, len(values))
+	for _, value := range values {
+		startStr, endStr, found := strings.Cut(value, "-")
+		start, err := strconv.ParseUint(strings.TrimSpace(startStr), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %s: %w", value, err)
+		}
+		end := start
+		if found {
+			end, err = strconv.ParseUint(strings.TrimSpace(endStr), 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port %s: %w", value, err)
+			}
+		}
+		if end < start {
+			return nil, errors.New("invalid port range: " + value)
+		}
+		ranges = append(ranges, PortRange{Start: uint16(start), End: uint16(end)})
+	}
+	return ranges, nil
+}
+
+// addRouteTargets adds domain names and CIDRs to the conditions of rule
+func addRouteTargets(rule *RouteRule, values []string) {
+	for _, value := range values {
+		if prefix, err := netip.ParsePrefix(value); err == nil {
+			rule.Prefixes = append(rule.Prefixes, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(value); err == nil {
+			rule.Prefixes = append(rule.Prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		} else {
+			rule.Domains = append(rule.Domains, strings.Trim(strings.ToLower(value), "."))
+		}
+	}
+}
+
+// loadRouteList reads a list file holding one domain name or CIDR per line, with # comments
+func loadRouteList(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		line = strings.TrimSpace(line)
+		if line != "" {
+			values = append(values, line)
+		}
+	}
+	return values, nil
+}
+
+// parseRouteConditions reads the Domain, CIDR, List and Port conditions of a section into rule
+func parseRouteConditions(section *ini.Section, rule *RouteRule) error {
+	domains, err := parseStringList(section, "Domain")
+	if err != nil {
+		return err
+	}
+	addRouteTargets(rule, domains)
+
+	cidrs, err := parseStringList(section, "CIDR")
+	if err != nil {
+		return err
+	}
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return err
+		}
+		rule.Prefixes = append(rule.Prefixes, prefix.Masked())
+	}
+
+	lists, err := parseStringList(section, "List")
+	if err != nil {
+		return err
+	}
+	for _, list := range lists {
+		values, err := loadRouteList(list)
+		if err != nil {
+			return err
+		}
+		addRouteTargets(rule, values)
+	}
+
+	rule.Ports, err = parsePortRanges(section, "Port")
+	return err
+}
+
+func parseRouteRule(section *ini.Section, tunnels map[string]*DeviceConfig) (*RouteRule, error) {
+	rule := &RouteRule{}
+
+	err := parseRouteConditions(section, rule)
+	if err != nil {
+		return nil, err
+	}
+
+	action, err := parseString(section, "Action")
+	if err != nil {
+		return nil, err
+	}
+	rule.Action = strings.ToLower(action)
+	switch rule.Action {
+	case RouteTunnel, RouteDirect, RouteReject:
+	case "":
+		return nil, errors.New("Action should not be empty")
+	default:
+		if _, ok := tunnels[rule.Action]; !ok {
+			return nil, errors.New("unknown device: " + rule.Action)
+		}
+	}
+
+	return rule, nil
+}
+
+// parseByteSize reads a number of bytes, which may be suffixed by K, M, G or T for powers of 1024
+func parseByteSize(section *ini.Section, keyName string) (int64, error) {
+	value, err := parseString(section, keyName)
+	if err != nil || value == "" {
+		return 0, err
+	}
+
+	value = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	multiplier := int64(1)
+	if i := strings.IndexAny(value, "KMGT"); i >= 0 && i == len(value)-1 {
+		multiplier = 1 << (10 * (strings.IndexByte("KMGT", value[i]) + 1))
+		value = value[:i]
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", keyName, err)
+	}
+	if size < 0 {
+		return 0, errors.New(keyName + " must not be negative")
+	}
+	return size * multiplier, nil
+}
+
+func parseUserPolicy(section *ini.Section) (*UserPolicy, error) {
+	policy := &UserPolicy{}
+
+	name, err := parseString(section, "Name")
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, errors.New("Name should not be empty")
+	}
+	policy.Name = name
+
+	err = parseRouteConditions(section, &policy.Destinations)
+	if err != nil {
+		return nil, err
+	}
+
+	if sectionKey, err := section.GetKey("MaxConnections"); err == nil {
+		policy.MaxConnections, err = sectionKey.Int()
+		if err != nil {
+			return nil, err
+		}
+		if policy.MaxConnections < 0 {
+			return nil, errors.New("MaxConnections must not be negative")
+		}
+	}
+
+	policy.Bandwidth, err = parseByteSize(section, "Bandwidth")
+	if err != nil {
+		return nil, err
+	}
+
+	policy.MonthlyQuota, err = parseByteSize(section, "MonthlyQuota")
+	if err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+func parsePACConfig(section *ini.Section) (*PACConfig, error) {
+	config := &PACConfig{}
+
+	var err error
+	config.Host, err = parseString(section, "Host")
+	if err != nil {
+		return nil, err
+	}
+
+	var targets RouteRule
+	err = parseRouteConditions(section, &targets)
+	if err != nil {
+		return nil, err
+	}
+	config.Domains = targets.Domains
+	config.Prefixes = targets.Prefixes
+
+	return config, nil
+}
+
+func parseTunnelSelection(section *ini.Section) (TunnelSelection, error) {
+	selection := TunnelSelection{Balance: BalanceRoundRobin}
+
+	devices, err := parseStringList(section, "Device")
+	if err != nil {
+		return selection, err
+	}
+	for _, device := range devices {
+		selection.Devices = append(selection.Devices, strings.ToLower(device))
+	}
+
+	if sectionKey, err := section.GetKey("Balance"); err == nil {
+		selection.Balance = strings.ToLower(sectionKey.String())
+		switch selection.Balance {
+		case BalanceRoundRobin, BalanceLeastConn, BalanceWeighted:
+		default:
+			return selection, errors.New("unknown balance strategy: " + sectionKey.String())
+		}
+	}
+
+	if _, err := section.GetKey("Weights"); err == nil {
+		if selection.Balance != BalanceWeighted {
+			return selection, errors.New("Weights is only valid with the weighted balance strategy")
+		}
+		values, err := parseStrings(section, "Weights")
+		if err != nil {
+			return selection, err
+		}
+		for _, value := range values {
+			weight, err := strconv.Atoi(value)
+			if err != nil {
+				return selection, err
+			}
+			if weight <= 0 {
+				return selection, errors.New("weights must be positive")
+			}
+			selection.Weights = append(selection.Weights, weight)
+		}
+		if len(selection.Weights) != len(selection.Devices) {
+			return selection, errors.New("Weights must have one value per device")
+		}
+	} else if selection.Balance == BalanceWeighted {
+		return selection, errors.New("the weighted balance strategy requires Weights")
+	}
+
+	return selection, nil
+}
+
 // Takes a function that parses an individual section into a config, and apply it on all
 // specified sections
 func parseRoutinesConfig(routines *[]RoutineSpawner, cfg *ini.File, sectionName string, f func(*ini.Section) (RoutineSpawner, error)) error {
@@ -691,8 +1392,66 @@ func parseRoutinesConfig(routines *[]RoutineSpawner, cfg *ini.File, sectionName
 	return nil
 }
 
-// ParseConfig takes the path of a configuration file and parses it into Configuration
+// parseProxySections parses the routines, [Rule] and [User] sections of cfg, adding them to routines, rules and users
+func parseProxySections(cfg *ini.File, tunnels map[string]*DeviceConfig, routines *[]RoutineSpawner, rules *[]*RouteRule, users map[string]*UserPolicy) error {
+	err := parseRoutinesConfig(routines, cfg, "Socks5", parseSocks5Config)
+	if err != nil {
+		return err
+	}
+
+	err = parseRoutinesConfig(routines, cfg, "http", parseHTTPConfig)
+	if err != nil {
+		return err
+	}
+
+	err = parseRoutinesConfig(routines, cfg, "Mixed", parseMixedConfig)
+	if err != nil {
+		return err
+	}
+
+	err = parseRoutinesConfig(routines, cfg, "TransparentTCP", parseTransparentTCPConfig)
+	if err != nil {
+		return err
+	}
+
+	err = parseRoutinesConfig(routines, cfg, "SNIProxy", parseSNIProxyConfig)
+	if err != nil {
+		return err
+	}
+
+	if sections, err := cfg.SectionsByName("Rule"); err == nil {
+		for _, section := range sections {
+			rule, err := parseRouteRule(section, tunnels)
+			if err != nil {
+				return err
+			}
+			*rules = append(*rules, rule)
+		}
+	}
+
+	if sections, err := cfg.SectionsByName("User"); err == nil {
+		for _, section := range sections {
+			policy, err := parseUserPolicy(section)
+			if err != nil {
+				return err
+			}
+			if _, ok := users[policy.Name]; ok {
+				return errors.New("duplicate [User] section for " + policy.Name)
+			}
+			users[policy.Name] = policy
+		}
+	}
+
+	return nil
+}
+
+// ParseConfig takes the path of a configuration file and parses it into Configuration.
+// The format of the file is guessed from its extension, see ConfigFormat.
 func ParseConfig(path string) (*Configuration, error) {
+	return ParseConfigAs(path, ConfigFormat(path))
+}
+
+func parseINIConfig(path string) (*Configuration, error) {
 	iniOpt := ini.LoadOptions{
 		Insensitive:            true,
 		AllowShadows:           true,
@@ -704,7 +1463,7 @@ func ParseConfig(path string) (*Configuration, error) {
 		return nil, err
 	}
 
-	return Parse(cfg)
+	return parse(cfg, path)
 }
 
 // ParseConfigString takes the config as a string and parses it into Configuration
@@ -725,52 +1484,199 @@ func ParseConfigString(config string) (*Configuration, error) {
 }
 
 func Parse(cfg *ini.File) (*Configuration, error) {
+	return parse(cfg, "")
+}
+
+// parse parses cfg, read from path when it comes from a file. Relative Include
+// patterns are resolved from the directory of path, or the working directory.
+func parse(cfg *ini.File, path string) (*Configuration, error) {
 	iniOpt := ini.LoadOptions{
 		Insensitive:            true,
 		AllowShadows:           true,
 		AllowNonUniqueSections: true,
 	}
 
-	device := &DeviceConfig{
-		MTU: 1420,
+	var devices []*DeviceConfig
+
+	tunnels, tunnelNames, err := parseNamedDevices(cfg)
+	if err != nil {
+		return nil, err
 	}
 
 	root := cfg.Section("")
-	wgConf, err := root.GetKey("WGConfig")
-	wgCfg := cfg
-	if err == nil {
-		wgCfg, err = ini.LoadSources(iniOpt, wgConf.String())
+	if wgConf, err := root.GetKey("WGConfig"); err == nil {
+		// Every WGConfig entry is a device, the first one having the highest priority
+		names := make(map[string]bool)
+		for _, path := range wgConf.ValueWithShadows() {
+			var device *DeviceConfig
+			if IsAmneziaLink(path) {
+				device, err = ParseAmneziaConfig(path)
+				if err != nil {
+					return nil, fmt.Errorf("WGConfig: %w", err)
+				}
+				device.Name = amneziaDeviceName(device)
+			} else {
+				wgCfg, err := ini.LoadSources(iniOpt, path)
+				if err != nil {
+					return nil, err
+				}
+
+				device, err = parseDevice(wgCfg)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", path, err)
+				}
+				device.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+			}
+
+			// The names tell the devices apart in the failover logs
+			if names[device.Name] {
+				return nil, errors.New("WGConfig: duplicate device name " + device.Name)
+			}
+			names[device.Name] = true
+			devices = append(devices, device)
+		}
+	} else if _, err := cfg.GetSection("Interface"); err == nil || len(tunnelNames) == 0 {
+		device, err := parseDevice(cfg)
 		if err != nil {
 			return nil, err
 		}
+		devices = append(devices, device)
+	} else {
+		// Without an unnamed device, the first named one is the default
+		devices = append(devices, tunnels[tunnelNames[0]])
 	}
 
-	err = ParseInterface(wgCfg, device)
+	var routinesSpawners []RoutineSpawner
+	var rules []*RouteRule
+	users := make(map[string]*UserPolicy)
+
+	err = parseProxySections(cfg, tunnels, &routinesSpawners, &rules, users)
 	if err != nil {
 		return nil, err
 	}
 
-	err = ParsePeers(wgCfg, &device.Peers)
+	includes, err := loadIncludes(cfg, path, nil, make(map[string]bool))
 	if err != nil {
 		return nil, err
 	}
+	for _, include := range includes {
+		err = parseProxySections(include.cfg, tunnels, &routinesSpawners, &rules, users)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", include.path, err)
+		}
+	}
 
-	var routinesSpawners []RoutineSpawner
+	var pac *PACConfig
+	if section, err := cfg.GetSection("PAC"); err == nil {
+		pac, err = parsePACConfig(section)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, routine := range routinesSpawners {
+		selector, ok := routine.(tunnelSelector)
+		if !ok {
+			continue
+		}
+		for _, name := range selector.tunnelNames() {
+			if _, ok := tunnels[name]; !ok {
+				return nil, errors.New("unknown device: " + name)
+			}
+		}
+	}
 
-	err = parseRoutinesConfig(&routinesSpawners, cfg, "Socks5", parseSocks5Config)
+	return &Configuration{
+		Device:   devices[0],
+		Devices:  devices,
+		Tunnels:  tunnels,
+		Rules:    rules,
+		Users:    users,
+		PAC:      pac,
+		Routines: routinesSpawners,
+	}, nil
+}
+
+// detachSection copies the keys of section into a standalone section. go-ini treats
+// [Interface.<name>] as a child of [Interface] and falls back to the parent for missing
+// keys, which must not happen between unrelated devices.
+func detachSection(section *ini.Section) *ini.Section {
+	file := ini.Empty(ini.LoadOptions{
+		Insensitive:            true,
+		AllowShadows:           true,
+		AllowNonUniqueSections: true,
+	})
+	detached, _ := file.NewSection(section.Name())
+	for _, key := range section.Keys() {
+		for _, value := range key.ValueWithShadows() {
+			_, _ = detached.NewKey(key.Name(), value)
+		}
+	}
+	return detached
+}
+
+// parseNamedDevices parses every [Interface.<name>] section together with its
+// [Peer.<name>] sections. The names are returned in the order they appear in cfg.
+func parseNamedDevices(cfg *ini.File) (map[string]*DeviceConfig, []string, error) {
+	tunnels := make(map[string]*DeviceConfig)
+	var names []string
+
+	for _, section := range cfg.Sections() {
+		name, ok := strings.CutPrefix(section.Name(), "interface.")
+		if !ok {
+			continue
+		}
+		if name == "" {
+			return nil, nil, errors.New("device name should not be empty")
+		}
+		if _, ok := tunnels[name]; ok {
+			return nil, nil, errors.New("one and only one [Interface." + name + "] is expected")
+		}
+
+		device := &DeviceConfig{
+			Name: name,
+			MTU:  1420,
+		}
+		if err := parseInterfaceSection(detachSection(section), device); err != nil {
+			return nil, nil, fmt.Errorf("[Interface.%s]: %w", name, err)
+		}
+
+		sections, err := cfg.SectionsByName("peer." + name)
+		if err != nil {
+			sections = nil
+		}
+		peers := make([]*ini.Section, 0, len(sections))
+		for _, section := range sections {
+			peers = append(peers, detachSection(section))
+		}
+		if err := parsePeerSections(peers, &device.Peers); err != nil {
+			return nil, nil, fmt.Errorf("[Peer.%s]: %w", name, err)
+		}
+
+		tunnels[name] = device
+		names = append(names, name)
+	}
+
+	return tunnels, names, nil
+}
+
+// parseDevice parses the [Interface] and [Peer] sections of cfg into a DeviceConfig
+func parseDevice(cfg *ini.File) (*DeviceConfig, error) {
+	device := &DeviceConfig{
+		MTU: 1420,
+	}
+
+	err := ParseInterface(cfg, device)
 	if err != nil {
 		return nil, err
 	}
 
-	err = parseRoutinesConfig(&routinesSpawners, cfg, "http", parseHTTPConfig)
+	err = ParsePeers(cfg, &device.Peers)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Configuration{
-		Device:   device,
-		Routines: routinesSpawners,
-	}, nil
+	return device, nil
 }
 
 // CreateIPCRequest serialize the config into an IPC request and DeviceSetting
@@ -904,7 +1810,8 @@ func (p *PeerConfig) NeedsResolution() bool {
 	}
 	host, _, err := net.SplitHostPort(*p.Endpoint)
 	if err != nil {
-		return false
+		// SRV names such as _wireguard._udp.example.com come without a port
+		return isSRVName(*p.Endpoint)
 	}
 	_, err = netip.ParseAddr(host)
 	return err != nil // parse failed, it's a domain
@@ -915,10 +1822,13 @@ func (p *PeerConfig) UpdateEndpointIP(resolvedIP netip.Addr) error {
 	if p.Endpoint == nil {
 		return errors.New("no endpoint set")
 	}
-	_, port, err := net.SplitHostPort(*p.Endpoint)
+	host, port, err := net.SplitHostPort(*p.Endpoint)
 	if err != nil {
 		return err
 	}
+	if _, err := netip.ParseAddr(host); err != nil {
+		p.hostname = host
+	}
 
 	ipStr := resolvedIP.String()
 	if resolvedIP.Is6() {
@@ -0,0 +1,221 @@
+package wireproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-ini/ini"
+	"gopkg.in/yaml.v3"
+)
+
+// Supported configuration formats
+const (
+	FormatINI  = "ini"
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+)
+
+// ConfigFormat guesses the format of a configuration file from its extension, defaulting to INI
+func ConfigFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".json":
+		return FormatJSON
+	default:
+		return FormatINI
+	}
+}
+
+// ParseConfigAs takes the path of a configuration file in the given format and parses it into Configuration
+func ParseConfigAs(path, format string) (*Configuration, error) {
+	if format == FormatINI {
+		return parseINIConfig(path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := loadConfigStringAs(string(data), format)
+	if err != nil {
+		return nil, err
+	}
+	return parse(cfg, path)
+}
+
+// ParseConfigStringAs takes the config as a string in the given format and parses it into Configuration
+func ParseConfigStringAs(config, format string) (*Configuration, error) {
+	cfg, err := loadConfigStringAs(config, format)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(cfg)
+}
+
+// loadConfigStringAs loads the config as a string in the given format into the equivalent ini.File
+func loadConfigStringAs(config, format string) (*ini.File, error) {
+	var cfg *ini.File
+	var err error
+
+	switch format {
+	case FormatINI:
+		return ini.LoadSources(ini.LoadOptions{
+			Insensitive:            true,
+			AllowShadows:           true,
+			AllowNonUniqueSections: true,
+		}, []byte(config))
+	case FormatJSON:
+		var doc *yaml.Node
+		dec := json.NewDecoder(strings.NewReader(config))
+		dec.UseNumber()
+		doc, err = decodeJSONNode(dec)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := dec.Token(); err != io.EOF {
+			return nil, errors.New("unexpected data after the JSON configuration")
+		}
+		cfg, err = loadStructuredConfig(doc)
+	case FormatYAML:
+		var doc yaml.Node
+		if err := yaml.Unmarshal([]byte(config), &doc); err != nil {
+			return nil, err
+		}
+		if len(doc.Content) == 0 {
+			return nil, errors.New("configuration should not be empty")
+		}
+		cfg, err = loadStructuredConfig(doc.Content[0])
+	default:
+		return nil, errors.New("unknown configuration format: " + format)
+	}
+	return cfg, err
+}
+
+// loadStructuredConfig converts a YAML or JSON document into the equivalent ini.File.
+// The document is a mapping where scalar values are root keys, mappings are sections
+// and sequences of mappings are repeated sections. Sequences of scalars are repeated keys.
+func loadStructuredConfig(root *yaml.Node) (*ini.File, error) {
+	cfg := ini.Empty(ini.LoadOptions{
+		Insensitive:            true,
+		AllowShadows:           true,
+		AllowNonUniqueSections: true,
+		// Sequences may repeat a value, like the weights of a balanced routine
+		AllowDuplicateShadowValues: true,
+	})
+
+	if root.Kind != yaml.MappingNode {
+		return nil, errors.New("configuration should be a mapping")
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		name := root.Content[i].Value
+		value := root.Content[i+1]
+
+		switch value.Kind {
+		case yaml.ScalarNode:
+			if _, err := cfg.Section("").NewKey(name, value.Value); err != nil {
+				return nil, err
+			}
+		case yaml.MappingNode:
+			if err := addStructuredSection(cfg, name, value); err != nil {
+				return nil, err
+			}
+		case yaml.SequenceNode:
+			for _, item := range value.Content {
+				switch item.Kind {
+				case yaml.MappingNode:
+					if err := addStructuredSection(cfg, name, item); err != nil {
+						return nil, err
+					}
+				case yaml.ScalarNode:
+					if _, err := cfg.Section("").NewKey(name, item.Value); err != nil {
+						return nil, err
+					}
+				default:
+					return nil, errors.New("unexpected value in " + name)
+				}
+			}
+		default:
+			return nil, errors.New("unexpected value for " + name)
+		}
+	}
+
+	return cfg, nil
+}
+
+func addStructuredSection(cfg *ini.File, name string, node *yaml.Node) error {
+	section, err := cfg.NewSection(name)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i].Value
+		value := node.Content[i+1]
+
+		switch value.Kind {
+		case yaml.ScalarNode:
+			if _, err := section.NewKey(key, value.Value); err != nil {
+				return err
+			}
+		case yaml.SequenceNode:
+			for _, item := range value.Content {
+				if item.Kind != yaml.ScalarNode {
+					return fmt.Errorf("unexpected value in [%s] %s", name, key)
+				}
+				if _, err := section.NewKey(key, item.Value); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("unexpected value for [%s] %s", name, key)
+		}
+	}
+
+	return nil
+}
+
+// decodeJSONNode reads the next JSON value of dec into a yaml.Node, keeping the order of the keys
+func decodeJSONNode(dec *json.Decoder) (*yaml.Node, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token := token.(type) {
+	case json.Delim:
+		node := &yaml.Node{Kind: yaml.SequenceNode}
+		if token == '{' {
+			node.Kind = yaml.MappingNode
+		}
+		for dec.More() {
+			if node.Kind == yaml.MappingNode {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key.(string)})
+			}
+			value, err := decodeJSONNode(dec)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, value)
+		}
+		// Consume the closing delimiter
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return node, nil
+	case nil:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null"}, nil
+	default:
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: fmt.Sprint(token)}, nil
+	}
+}
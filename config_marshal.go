@@ -0,0 +1,452 @@
+package wireproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+const zeroKey = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// iniMarshaler is implemented by the routines that can be written back to a configuration file
+type iniMarshaler interface {
+	marshalINI(cfg *ini.File) error
+}
+
+// MarshalINI serializes the configuration into the INI format read by ParseConfig
+func (c *Configuration) MarshalINI() ([]byte, error) {
+	if len(c.Devices) > 1 {
+		return nil, errors.New("failover devices loaded with WGConfig cannot be marshaled")
+	}
+
+	cfg := ini.Empty(ini.LoadOptions{AllowShadows: true, AllowNonUniqueSections: true})
+
+	// The default device goes first, so that it stays the default when it is a named one
+	devices := []*DeviceConfig{c.Device}
+	names := make([]string, 0, len(c.Tunnels))
+	for name := range c.Tunnels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if c.Tunnels[name] != c.Device {
+			devices = append(devices, c.Tunnels[name])
+		}
+	}
+
+	for _, device := range devices {
+		if err := device.marshalINI(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, rule := range c.Rules {
+		section, err := cfg.NewSection("Rule")
+		if err != nil {
+			return nil, err
+		}
+		setList(section, "Domain", rule.Domains)
+		setList(section, "CIDR", rule.Prefixes)
+		setList(section, "Port", rule.Ports)
+		setKey(section, "Action", rule.Action)
+	}
+
+	userNames := make([]string, 0, len(c.Users))
+	for name := range c.Users {
+		userNames = append(userNames, name)
+	}
+	sort.Strings(userNames)
+	for _, name := range userNames {
+		policy := c.Users[name]
+		section, err := cfg.NewSection("User")
+		if err != nil {
+			return nil, err
+		}
+		setKey(section, "Name", escapeEnv(policy.Name))
+		setList(section, "Domain", policy.Destinations.Domains)
+		setList(section, "CIDR", policy.Destinations.Prefixes)
+		setList(section, "Port", policy.Destinations.Ports)
+		if policy.MaxConnections > 0 {
+			setKey(section, "MaxConnections", strconv.Itoa(policy.MaxConnections))
+		}
+		if policy.Bandwidth > 0 {
+			setKey(section, "Bandwidth", strconv.FormatInt(policy.Bandwidth, 10))
+		}
+		if policy.MonthlyQuota > 0 {
+			setKey(section, "MonthlyQuota", strconv.FormatInt(policy.MonthlyQuota, 10))
+		}
+	}
+
+	if c.PAC != nil {
+		section, err := cfg.NewSection("PAC")
+		if err != nil {
+			return nil, err
+		}
+		setKey(section, "Host", escapeEnv(c.PAC.Host))
+		setList(section, "Domain", c.PAC.Domains)
+		setList(section, "CIDR", c.PAC.Prefixes)
+	}
+
+	for _, routine := range c.Routines {
+		marshaler, ok := routine.(iniMarshaler)
+		if !ok {
+			return nil, fmt.Errorf("routine %T cannot be marshaled", routine)
+		}
+		if err := marshaler.marshalINI(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := cfg.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// MarshalWGQuick serializes the [Interface] and [Peer] sections of the device in the
+// wg-quick format, leaving out the keys that only wireproxy understands
+func (d *DeviceConfig) MarshalWGQuick() ([]byte, error) {
+	var buf bytes.Buffer
+
+	privateKey, err := encodeHexToBase64(d.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	buf.WriteString("[Interface]\n")
+	writeWGQuickKey(&buf, "PrivateKey", privateKey)
+	writeWGQuickKey(&buf, "Address", joinList(d.Address))
+	writeWGQuickKey(&buf, "DNS", joinList(d.dnsList()))
+	writeWGQuickKey(&buf, "MTU", strconv.Itoa(d.MTU))
+	if d.ListenPort != nil {
+		writeWGQuickKey(&buf, "ListenPort", strconv.Itoa(*d.ListenPort))
+	}
+	if d.ASecConfig != nil {
+		for _, pair := range d.ASecConfig.keys() {
+			writeWGQuickKey(&buf, pair[0], pair[1])
+		}
+	}
+
+	peers, err := d.peerKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, pairs := range peers {
+		buf.WriteString("\n[Peer]\n")
+		for _, pair := range pairs {
+			writeWGQuickKey(&buf, pair[0], pair[1])
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (d *DeviceConfig) marshalINI(cfg *ini.File) error {
+	interfaceName, peerName := "Interface", "Peer"
+	if d.Name != "" {
+		interfaceName += "." + d.Name
+		peerName += "." + d.Name
+	}
+
+	section, err := cfg.NewSection(interfaceName)
+	if err != nil {
+		return err
+	}
+
+	privateKey, err := encodeHexToBase64(d.SecretKey)
+	if err != nil {
+		return err
+	}
+	setKey(section, "PrivateKey", privateKey)
+	setList(section, "Address", d.Address)
+	setList(section, "DNS", d.dnsList())
+	setKey(section, "MTU", strconv.Itoa(d.MTU))
+	if d.ListenPort != nil {
+		setKey(section, "ListenPort", strconv.Itoa(*d.ListenPort))
+	}
+	if len(d.CheckAlive) > 0 {
+		setList(section, "CheckAlive", d.CheckAlive)
+		setKey(section, "CheckAliveInterval", strconv.Itoa(d.CheckAliveInterval))
+	}
+	if d.RestartThreshold > 0 {
+		setKey(section, "RestartThreshold", strconv.Itoa(d.RestartThreshold))
+		setKey(section, "RestartMaxBackoff", strconv.Itoa(d.RestartMaxBackoff))
+	}
+	if d.DomainBlockingEnabled {
+		setKey(section, "DomainBlockingEnabled", "true")
+	}
+	setList(section, "BlockedDomains", d.BlockedDomains)
+	if d.ASecConfig != nil {
+		for _, pair := range d.ASecConfig.keys() {
+			setKey(section, pair[0], pair[1])
+		}
+	}
+	setRepeated(section, "OnUp", d.OnUp)
+	setRepeated(section, "OnDown", d.OnDown)
+	setRepeated(section, "OnHandshake", d.OnHandshake)
+	setRepeated(section, "OnHealthChange", d.OnHealthChange)
+
+	peers, err := d.peerKeys()
+	if err != nil {
+		return err
+	}
+	for _, pairs := range peers {
+		section, err := cfg.NewSection(peerName)
+		if err != nil {
+			return err
+		}
+		for _, pair := range pairs {
+			setKey(section, pair[0], pair[1])
+		}
+	}
+
+	return nil
+}
+
+// dnsList merges the DNS servers and search domains back into the DNS key
+func (d *DeviceConfig) dnsList() []string {
+	dns := make([]string, 0, len(d.DNS)+len(d.SearchDomains))
+	for _, addr := range d.DNS {
+		dns = append(dns, addr.String())
+	}
+	return append(dns, d.SearchDomains...)
+}
+
+// keys lists the AWG parameters as they are written in a configuration file
+func (c *ASecConfigType) keys() [][2]string {
+	pairs := [][2]string{
+		{"Jc", strconv.Itoa(c.junkPacketCount)},
+		{"Jmin", strconv.Itoa(c.junkPacketMinSize)},
+		{"Jmax", strconv.Itoa(c.junkPacketMaxSize)},
+		{"S1", strconv.Itoa(c.initPacketJunkSize)},
+		{"S2", strconv.Itoa(c.responsePacketJunkSize)},
+	}
+	if c.cookieReplyPacketJunkSize != 0 {
+		pairs = append(pairs, [2]string{"S3", strconv.Itoa(c.cookieReplyPacketJunkSize)})
+	}
+	if c.transportPacketJunkSize != 0 {
+		pairs = append(pairs, [2]string{"S4", strconv.Itoa(c.transportPacketJunkSize)})
+	}
+	for i, header := range []string{
+		c.initPacketMagicHeader,
+		c.responsePacketMagicHeader,
+		c.underloadPacketMagicHeader,
+		c.transportPacketMagicHeader,
+	} {
+		if header != "" {
+			pairs = append(pairs, [2]string{"H" + strconv.Itoa(i+1), header})
+		}
+	}
+	for i, packet := range []*string{c.i1, c.i2, c.i3, c.i4, c.i5} {
+		if packet != nil {
+			pairs = append(pairs, [2]string{"I" + strconv.Itoa(i+1), *packet})
+		}
+	}
+	return pairs
+}
+
+// peerKeys lists the settings of every peer, see PeerConfig.keys
+func (d *DeviceConfig) peerKeys() ([][][2]string, error) {
+	d.endpointLock.Lock()
+	defer d.endpointLock.Unlock()
+
+	peers := make([][][2]string, 0, len(d.Peers))
+	for i := range d.Peers {
+		pairs, err := d.Peers[i].keys()
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, pairs)
+	}
+	return peers, nil
+}
+
+// keys lists the peer settings as they are written in a configuration file
+func (p *PeerConfig) keys() ([][2]string, error) {
+	publicKey, err := encodeHexToBase64(p.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := [][2]string{{"PublicKey", publicKey}}
+	if p.PreSharedKey != "" && p.PreSharedKey != zeroKey {
+		preSharedKey, err := encodeHexToBase64(p.PreSharedKey)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, [2]string{"PreSharedKey", preSharedKey})
+	}
+	if p.Endpoint != nil {
+		pairs = append(pairs, [2]string{"Endpoint", p.configuredEndpoint()})
+	}
+	if p.KeepAlive != 0 {
+		pairs = append(pairs, [2]string{"PersistentKeepalive", strconv.Itoa(p.KeepAlive)})
+	}
+	if len(p.AllowedIPs) > 0 {
+		pairs = append(pairs, [2]string{"AllowedIPs", joinList(p.AllowedIPs)})
+	}
+	return pairs, nil
+}
+
+func (config *Socks5Config) marshalINI(cfg *ini.File) error {
+	section, err := cfg.NewSection("Socks5")
+	if err != nil {
+		return err
+	}
+	setKey(section, "BindAddress", escapeEnv(config.BindAddress))
+	setKey(section, "Username", escapeEnv(config.Username))
+	setKey(section, "Password", escapeSecret(config.Password))
+	setKey(section, "UsersFile", escapeEnv(config.UsersFile))
+	setList(section, "AllowFrom", config.AllowFrom)
+	config.TunnelSelection.marshalINI(section)
+	return nil
+}
+
+func (config *MixedConfig) marshalINI(cfg *ini.File) error {
+	section, err := cfg.NewSection("Mixed")
+	if err != nil {
+		return err
+	}
+	setKey(section, "BindAddress", escapeEnv(config.BindAddress))
+	setKey(section, "Username", escapeEnv(config.Username))
+	setKey(section, "Password", escapeSecret(config.Password))
+	setKey(section, "UsersFile", escapeEnv(config.UsersFile))
+	setList(section, "AllowFrom", config.AllowFrom)
+	config.TunnelSelection.marshalINI(section)
+	return nil
+}
+
+func (config *TransparentTCPConfig) marshalINI(cfg *ini.File) error {
+	section, err := cfg.NewSection("TransparentTCP")
+	if err != nil {
+		return err
+	}
+	setKey(section, "BindAddress", escapeEnv(config.BindAddress))
+	setList(section, "AllowFrom", config.AllowFrom)
+	if config.TProxy {
+		setKey(section, "TProxy", "true")
+	}
+	config.TunnelSelection.marshalINI(section)
+	return nil
+}
+
+func (config *SNIProxyConfig) marshalINI(cfg *ini.File) error {
+	section, err := cfg.NewSection("SNIProxy")
+	if err != nil {
+		return err
+	}
+	setKey(section, "BindAddress", escapeEnv(config.BindAddress))
+	setList(section, "AllowFrom", config.AllowFrom)
+	setList(section, "Domain", config.Allowed.Domains)
+	setList(section, "CIDR", config.Allowed.Prefixes)
+	setList(section, "Port", config.Allowed.Ports)
+	if config.TargetPort != 0 {
+		setKey(section, "TargetPort", strconv.Itoa(int(config.TargetPort)))
+	}
+	config.TunnelSelection.marshalINI(section)
+	return nil
+}
+
+func (config *HTTPConfig) marshalINI(cfg *ini.File) error {
+	section, err := cfg.NewSection("http")
+	if err != nil {
+		return err
+	}
+	setKey(section, "BindAddress", escapeEnv(config.BindAddress))
+	setKey(section, "Username", escapeEnv(config.Username))
+	setKey(section, "Password", escapeSecret(config.Password))
+	setKey(section, "UsersFile", escapeEnv(config.UsersFile))
+	setList(section, "AllowFrom", config.AllowFrom)
+	setKey(section, "CertFile", escapeEnv(config.CertFile))
+	setKey(section, "KeyFile", escapeEnv(config.KeyFile))
+	setKey(section, "ClientCAFile", escapeEnv(config.ClientCAFile))
+	config.TunnelSelection.marshalINI(section)
+	return nil
+}
+
+func (s *TunnelSelection) marshalINI(section *ini.Section) {
+	setList(section, "Device", s.Devices)
+	if s.Balance != BalanceRoundRobin {
+		setKey(section, "Balance", s.Balance)
+	}
+	setList(section, "Weights", s.Weights)
+}
+
+func (p PortRange) String() string {
+	if p.Start == p.End {
+		return strconv.Itoa(int(p.Start))
+	}
+	return fmt.Sprintf("%d-%d", p.Start, p.End)
+}
+
+func encodeHexToBase64(key string) (string, error) {
+	decoded, err := hex.DecodeString(key)
+	if err != nil {
+		return "", errors.New("invalid hex key: " + key)
+	}
+	return base64.StdEncoding.EncodeToString(decoded), nil
+}
+
+// setKey adds the key to section unless value is empty
+func setKey(section *ini.Section, key, value string) {
+	if value != "" {
+		_, _ = section.NewKey(key, value)
+	}
+}
+
+// setList adds the values to section as a comma separated list unless there are none
+func setList[T any](section *ini.Section, key string, values []T) {
+	setKey(section, key, joinList(values))
+}
+
+// setRepeated adds the key to section once for every value
+func setRepeated(section *ini.Section, key string, values []string) {
+	for _, value := range values {
+		if existing, err := section.GetKey(key); err == nil {
+			_ = existing.AddShadow(value)
+		} else {
+			setKey(section, key, value)
+		}
+	}
+}
+
+func joinList[T any](values []T) string {
+	strs := make([]string, 0, len(values))
+	for _, value := range values {
+		if str := fmt.Sprint(value); str != "" {
+			strs = append(strs, str)
+		}
+	}
+	return strings.Join(strs, ", ")
+}
+
+// escapeEnv keeps a value starting with $ from being read back as an environment variable
+func escapeEnv(value string) string {
+	if strings.HasPrefix(value, "$") {
+		return "$" + value
+	}
+	return value
+}
+
+// escapeSecret keeps a secret value from being read back as an environment variable or as
+// a file: or exec: reference
+func escapeSecret(value string) string {
+	if isSecretReference(value) {
+		return `\` + value
+	}
+	return escapeEnv(value)
+}
+
+func writeWGQuickKey(buf *bytes.Buffer, key, value string) {
+	if value != "" {
+		buf.WriteString(key + " = " + value + "\n")
+	}
+}
@@ -1,6 +1,17 @@
 package wireproxy
 
 import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/go-ini/ini"
@@ -64,8 +75,8 @@ PersistentKeepalive = 25`
 	}
 }
 
-func TestWireguardConfWithAWGParams(t *testing.T) {
-	const config = `
+// awgParamsConfig is a device with AWG parameters
+const awgParamsConfig = `
 [Interface]
 PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
 Address = 10.5.0.2
@@ -85,8 +96,10 @@ PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
 AllowedIPs = 0.0.0.0/0, ::/0
 Addresses = 94.140.11.15:51820
 PersistentKeepalive = 25`
+
+func TestWireguardConfWithAWGParams(t *testing.T) {
 	var cfg DeviceConfig
-	iniData, err := loadIniConfig(config)
+	iniData, err := loadIniConfig(awgParamsConfig)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -117,18 +130,6 @@ PersistentKeepalive = 25`
 	if cfg.ASecConfig.i5 != nil {
 		t.Error("i5 should be nil when not set")
 	}
-	if cfg.ASecConfig.j1 != nil {
-		t.Error("j1 should be nil when not set")
-	}
-	if cfg.ASecConfig.j2 != nil {
-		t.Error("j2 should be nil when not set")
-	}
-	if cfg.ASecConfig.j3 != nil {
-		t.Error("j3 should be nil when not set")
-	}
-	if cfg.ASecConfig.itime != nil {
-		t.Error("itime should be nil when not set")
-	}
 
 	// Verify that required fields are set correctly
 	if cfg.ASecConfig.junkPacketCount != 5 {
@@ -146,16 +147,16 @@ PersistentKeepalive = 25`
 	if cfg.ASecConfig.responsePacketJunkSize != 0 {
 		t.Error("responsePacketJunkSize should be 0")
 	}
-	if cfg.ASecConfig.initPacketMagicHeader != 1 {
+	if cfg.ASecConfig.initPacketMagicHeader != "1" {
 		t.Error("initPacketMagicHeader should be 1")
 	}
-	if cfg.ASecConfig.responsePacketMagicHeader != 2 {
+	if cfg.ASecConfig.responsePacketMagicHeader != "2" {
 		t.Error("responsePacketMagicHeader should be 2")
 	}
-	if cfg.ASecConfig.underloadPacketMagicHeader != 3 {
+	if cfg.ASecConfig.underloadPacketMagicHeader != "3" {
 		t.Error("underloadPacketMagicHeader should be 3")
 	}
-	if cfg.ASecConfig.transportPacketMagicHeader != 4 {
+	if cfg.ASecConfig.transportPacketMagicHeader != "4" {
 		t.Error("transportPacketMagicHeader should be 4")
 	}
 }
@@ -218,18 +219,6 @@ PersistentKeepalive = 25`
 	if cfg.ASecConfig.i5 != nil {
 		t.Error("i5 should be nil when not set")
 	}
-	if cfg.ASecConfig.j1 != nil {
-		t.Error("j1 should be nil when not set")
-	}
-	if cfg.ASecConfig.j2 != nil {
-		t.Error("j2 should be nil when not set")
-	}
-	if cfg.ASecConfig.j3 != nil {
-		t.Error("j3 should be nil when not set")
-	}
-	if cfg.ASecConfig.itime != nil {
-		t.Error("itime should be nil when not set")
-	}
 
 	// Verify that required fields are set correctly
 	if cfg.ASecConfig.junkPacketCount != 5 {
@@ -247,16 +236,16 @@ PersistentKeepalive = 25`
 	if cfg.ASecConfig.responsePacketJunkSize != 0 {
 		t.Error("responsePacketJunkSize should be 0")
 	}
-	if cfg.ASecConfig.initPacketMagicHeader != 1 {
+	if cfg.ASecConfig.initPacketMagicHeader != "1" {
 		t.Error("initPacketMagicHeader should be 1")
 	}
-	if cfg.ASecConfig.responsePacketMagicHeader != 2 {
+	if cfg.ASecConfig.responsePacketMagicHeader != "2" {
 		t.Error("responsePacketMagicHeader should be 2")
 	}
-	if cfg.ASecConfig.underloadPacketMagicHeader != 3 {
+	if cfg.ASecConfig.underloadPacketMagicHeader != "3" {
 		t.Error("underloadPacketMagicHeader should be 3")
 	}
-	if cfg.ASecConfig.transportPacketMagicHeader != 4 {
+	if cfg.ASecConfig.transportPacketMagicHeader != "4" {
 		t.Error("transportPacketMagicHeader should be 4")
 	}
 }
@@ -267,7 +256,7 @@ func TestWireguardConfWithInvalid1AWGParams(t *testing.T) {
 PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
 Address = 10.5.0.2
 DNS = 1.1.1.1
-Jc = 200
+Jc = 201
 Jmin = 10
 Jmax = 50
 S1 = 0
@@ -288,7 +277,7 @@ PersistentKeepalive = 25`
 		t.Fatal(err)
 	}
 
-	expectedError := "value of the Jc field must be within the range of 1 to 128"
+	expectedError := "value of the Jc field must be within the range of 0 to 200"
 	err = ParseInterface(iniData, &cfg)
 	if err == nil {
 		t.Fatal("error expected")
@@ -362,7 +351,7 @@ PersistentKeepalive = 25`
 		t.Fatal(err)
 	}
 
-	expectedError := "value of the Jmax field must be less than or equal 1280"
+	expectedError := "value of the Jmax field must be within the range of 0 to 1280"
 	err = ParseInterface(iniData, &cfg)
 	if err == nil {
 		t.Fatal("error expected")
@@ -468,3 +457,1458 @@ Addresses = 192.200.144.22:51820`
 		t.Fatal(err)
 	}
 }
+
+func TestWireguardConfWithRestartThreshold(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+CheckAlive = 1.1.1.1
+RestartThreshold = 3
+RestartMaxBackoff = 60`
+	var cfg DeviceConfig
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ParseInterface(iniData, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RestartThreshold != 3 {
+		t.Errorf("RestartThreshold should be 3, got %d", cfg.RestartThreshold)
+	}
+	if cfg.RestartMaxBackoff != 60 {
+		t.Errorf("RestartMaxBackoff should be 60, got %d", cfg.RestartMaxBackoff)
+	}
+}
+
+func TestWireguardConfWithRestartThresholdWithoutCheckAlive(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+RestartThreshold = 3`
+	var cfg DeviceConfig
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedError := "RestartThreshold is only valid when CheckAlive is set"
+	err = ParseInterface(iniData, &cfg)
+	if err == nil {
+		t.Fatal("error expected")
+	}
+	if err.Error() != expectedError {
+		t.Fatalf("error expected: %s, got: %s", expectedError, err.Error())
+	}
+}
+
+func TestConfigWithMultipleWGConfig(t *testing.T) {
+	const primary = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = 94.140.11.15:51820`
+	const backup = `
+[Interface]
+PrivateKey = mBsVDahr1XIu9PPd17UmsDdB6E53nvmS47NbNqQCiFM=
+Address = 100.96.0.190
+
+[Peer]
+PublicKey = SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=
+Endpoint = 192.200.144.22:51820`
+
+	dir := t.TempDir()
+	primaryPath := filepath.Join(dir, "primary.conf")
+	backupPath := filepath.Join(dir, "backup.conf")
+	if err := os.WriteFile(primaryPath, []byte(primary), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(backupPath, []byte(backup), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := ParseConfigString(`
+WGConfig = ` + primaryPath + `
+WGConfig = ` + backupPath + `
+
+[Socks5]
+BindAddress = 127.0.0.1:25344`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(conf.Devices) != 2 {
+		t.Fatalf("expected 2 devices, got %d", len(conf.Devices))
+	}
+	if conf.Device != conf.Devices[0] {
+		t.Error("Device should be the first device")
+	}
+	if conf.Devices[0].Name != "primary" || conf.Devices[1].Name != "backup" {
+		t.Errorf("unexpected device order: %s, %s", conf.Devices[0].Name, conf.Devices[1].Name)
+	}
+	if conf.Devices[1].Address[0].String() != "100.96.0.190" {
+		t.Errorf("unexpected backup address: %s", conf.Devices[1].Address[0])
+	}
+
+	// Files named alike in different directories would give two devices the same name
+	otherPath := filepath.Join(t.TempDir(), "primary.conf")
+	if err := os.WriteFile(otherPath, []byte(backup), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseConfigString("WGConfig = " + primaryPath + "\nWGConfig = " + otherPath)
+	if err == nil || err.Error() != "WGConfig: duplicate device name primary" {
+		t.Errorf("unexpected error for duplicate device names: %v", err)
+	}
+}
+
+// namedDevicesConfig defines two named devices used by different proxies
+const namedDevicesConfig = `
+[Interface.work]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+DNS = 10.5.0.1
+
+[Peer.work]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = 94.140.11.15:51820
+
+[Interface.home]
+PrivateKey = mBsVDahr1XIu9PPd17UmsDdB6E53nvmS47NbNqQCiFM=
+Address = 100.96.0.190
+
+[Peer.home]
+PublicKey = SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=
+Endpoint = 192.200.144.22:51820
+
+[Socks5]
+BindAddress = 127.0.0.1:25344
+Device = work
+
+[http]
+BindAddress = 127.0.0.1:25345
+Device = home`
+
+func TestConfigWithNamedDevices(t *testing.T) {
+	conf, err := ParseConfigString(namedDevicesConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(conf.Tunnels) != 2 {
+		t.Fatalf("expected 2 tunnels, got %d", len(conf.Tunnels))
+	}
+	if conf.Device != conf.Tunnels["work"] {
+		t.Error("the first named device should be the default one")
+	}
+	if len(conf.Tunnels["home"].DNS) != 0 {
+		t.Error("home should not inherit the DNS of work")
+	}
+	if len(conf.Tunnels["home"].Peers) != 1 || conf.Tunnels["home"].Peers[0].Endpoint == nil ||
+		*conf.Tunnels["home"].Peers[0].Endpoint != "192.200.144.22:51820" {
+		t.Error("home should have its own peer")
+	}
+	if conf.Routines[1].(*HTTPConfig).Devices[0] != "home" {
+		t.Error("http routine should use the home device")
+	}
+}
+
+func TestConfigWithUnknownDevice(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Socks5]
+BindAddress = 127.0.0.1:25344
+Device = work`
+	_, err := ParseConfigString(config)
+	if err == nil {
+		t.Fatal("error expected")
+	}
+	if err.Error() != "unknown device: work" {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+}
+
+func TestConfigWithRouteRules(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(list, []byte("# internal networks\n10.0.0.0/8\ncorp.example\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Interface.work]
+PrivateKey = mBsVDahr1XIu9PPd17UmsDdB6E53nvmS47NbNqQCiFM=
+Address = 100.96.0.190
+
+[Rule]
+List = ` + list + `
+Action = work
+
+[Rule]
+Domain = .example.com
+Port = 80, 8000-8080
+Action = direct
+
+[Rule]
+CIDR = 192.168.0.0/16
+Action = reject`
+	conf, err := ParseConfigString(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Rules) != 3 {
+		t.Fatalf("expected 3 rules, got %d", len(conf.Rules))
+	}
+
+	vt := &VirtualTun{Rules: conf.Rules}
+	tests := []struct {
+		host   string
+		port   uint16
+		action string
+	}{
+		{"10.1.2.3", 443, "work"},
+		{"git.corp.example", 22, "work"},
+		{"www.example.com", 8080, RouteDirect},
+		{"example.com", 80, RouteDirect},
+		{"www.example.com", 443, RouteTunnel},
+		{"notexample.com", 80, RouteTunnel},
+		{"192.168.1.1", 22, RouteReject},
+	}
+	for _, test := range tests {
+		if action := vt.route(test.host, test.port); action != test.action {
+			t.Errorf("%s:%d should be routed to %s, got %s", test.host, test.port, test.action, action)
+		}
+	}
+}
+
+func TestConfigWithInvalidRouteAction(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Rule]
+Domain = example.com
+Action = home`
+	_, err := ParseConfigString(config)
+	if err == nil {
+		t.Fatal("error expected")
+	}
+	if err.Error() != "unknown device: home" {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+}
+
+// weightedBalanceConfig spreads the connections of a proxy over two devices
+const weightedBalanceConfig = `
+[Interface.work]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Interface.home]
+PrivateKey = mBsVDahr1XIu9PPd17UmsDdB6E53nvmS47NbNqQCiFM=
+Address = 100.96.0.190
+
+[Socks5]
+BindAddress = 127.0.0.1:25344
+Device = work, home
+Balance = weighted
+Weights = 3, 1`
+
+func TestConfigWithWeightedBalance(t *testing.T) {
+	conf, err := ParseConfigString(weightedBalanceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selection := conf.Routines[0].(*Socks5Config).TunnelSelection
+	if selection.Balance != BalanceWeighted {
+		t.Fatalf("unexpected balance strategy: %s", selection.Balance)
+	}
+
+	vt := &VirtualTun{Tunnels: map[string]*VirtualTun{}}
+	for name, device := range conf.Tunnels {
+		vt.Tunnels[name] = &VirtualTun{Conf: device, PingRecordLock: new(sync.Mutex)}
+	}
+	b, err := vt.newBalancer(selection)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	picks := make([]int, 2)
+	for i := 0; i < 8; i++ {
+		picks[b.pick()]++
+	}
+	if picks[0] != 6 || picks[1] != 2 {
+		t.Errorf("connections should be spread 6/2, got %d/%d", picks[0], picks[1])
+	}
+}
+
+func TestConfigWithWeightsWithoutWeightedBalance(t *testing.T) {
+	const config = `
+[Interface.work]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[http]
+BindAddress = 127.0.0.1:25345
+Device = work
+Weights = 1`
+	_, err := ParseConfigString(config)
+	if err == nil {
+		t.Fatal("error expected")
+	}
+	expectedError := "Weights is only valid with the weighted balance strategy"
+	if err.Error() != expectedError {
+		t.Fatalf("error expected: %s, got: %s", expectedError, err.Error())
+	}
+}
+
+// formatsConfig is the INI version of the YAML and JSON configurations of TestConfigFormats
+const formatsConfig = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+DNS = 1.1.1.1
+Jc = 5
+Jmin = 10
+Jmax = 50
+S1 = 0
+S2 = 0
+H1 = 1
+H2 = 2
+H3 = 3
+H4 = 4
+I1 = <b 0xA1B2C3D4E5F6>
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+AllowedIPs = 0.0.0.0/0, ::/0
+Endpoint = 94.140.11.15:51820
+PersistentKeepalive = 25
+
+[Socks5]
+BindAddress = 127.0.0.1:25344
+
+[http]
+BindAddress = 127.0.0.1:25345
+Username = peter
+Password = hunter123`
+
+func TestConfigFormats(t *testing.T) {
+	const yamlConfig = `
+Interface:
+  PrivateKey: LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+  Address: 10.5.0.2
+  DNS: [1.1.1.1]
+  Jc: 5
+  Jmin: 10
+  Jmax: 50
+  S1: 0
+  S2: 0
+  H1: 1
+  H2: 2
+  H3: 3
+  H4: 4
+  I1: "<b 0xA1B2C3D4E5F6>"
+Peer:
+  - PublicKey: e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+    AllowedIPs: [0.0.0.0/0, "::/0"]
+    Endpoint: 94.140.11.15:51820
+    PersistentKeepalive: 25
+Socks5:
+  BindAddress: 127.0.0.1:25344
+http:
+  - BindAddress: 127.0.0.1:25345
+    Username: peter
+    Password: hunter123
+`
+
+	const jsonConfig = `{
+	"Interface": {
+		"PrivateKey": "LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=",
+		"Address": "10.5.0.2",
+		"DNS": ["1.1.1.1"],
+		"Jc": 5, "Jmin": 10, "Jmax": 50,
+		"S1": 0, "S2": 0,
+		"H1": 1, "H2": 2, "H3": 3, "H4": 4,
+		"I1": "<b 0xA1B2C3D4E5F6>"
+	},
+	"Peer": [{
+		"PublicKey": "e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=",
+		"AllowedIPs": ["0.0.0.0/0", "::/0"],
+		"Endpoint": "94.140.11.15:51820",
+		"PersistentKeepalive": 25
+	}],
+	"Socks5": {"BindAddress": "127.0.0.1:25344"},
+	"http": [{"BindAddress": "127.0.0.1:25345", "Username": "peter", "Password": "hunter123"}]
+}`
+
+	expected, err := ParseConfigString(formatsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for format, config := range map[string]string{FormatYAML: yamlConfig, FormatJSON: jsonConfig} {
+		conf, err := ParseConfigStringAs(config, format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if !reflect.DeepEqual(conf, expected) {
+			t.Errorf("%s configuration differs from the INI one", format)
+		}
+	}
+}
+
+// convertINI writes an INI configuration in the YAML or JSON format, the sections appearing
+// more than once becoming sequences of mappings and the repeated root keys sequences of values
+func convertINI(t *testing.T, config, format string) string {
+	t.Helper()
+	cfg, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quote := func(value string) string {
+		data, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	// A key repeated inside a section becomes a sequence
+	quoteKey := func(key *ini.Key) string {
+		values := key.ValueWithShadows()
+		if len(values) == 1 {
+			return quote(values[0])
+		}
+		for i, value := range values {
+			values[i] = quote(value)
+		}
+		return "[" + strings.Join(values, ", ") + "]"
+	}
+
+	var names []string
+	sections := make(map[string][]*ini.Section)
+	for _, section := range cfg.Sections() {
+		if section == cfg.Section("") || len(section.Keys()) == 0 {
+			continue
+		}
+		if _, ok := sections[section.Name()]; !ok {
+			names = append(names, section.Name())
+		}
+		sections[section.Name()] = append(sections[section.Name()], section)
+	}
+
+	var buf strings.Builder
+	if format == FormatJSON {
+		var entries []string
+		for _, key := range cfg.Section("").Keys() {
+			var values []string
+			for _, value := range key.ValueWithShadows() {
+				values = append(values, quote(value))
+			}
+			entries = append(entries, quote(key.Name())+": ["+strings.Join(values, ", ")+"]")
+		}
+		for _, name := range names {
+			var mappings []string
+			for _, section := range sections[name] {
+				var keys []string
+				for _, key := range section.Keys() {
+					keys = append(keys, quote(key.Name())+": "+quoteKey(key))
+				}
+				mappings = append(mappings, "{"+strings.Join(keys, ", ")+"}")
+			}
+			entries = append(entries, quote(name)+": ["+strings.Join(mappings, ", ")+"]")
+		}
+		return "{\n" + strings.Join(entries, ",\n") + "\n}\n"
+	}
+
+	for _, key := range cfg.Section("").Keys() {
+		buf.WriteString(key.Name() + ":\n")
+		for _, value := range key.ValueWithShadows() {
+			buf.WriteString("  - " + quote(value) + "\n")
+		}
+	}
+	for _, name := range names {
+		buf.WriteString(quote(name) + ":\n")
+		for _, section := range sections[name] {
+			for i, key := range section.Keys() {
+				prefix := "    "
+				if i == 0 {
+					prefix = "  - "
+				}
+				buf.WriteString(prefix + key.Name() + ": " + quoteKey(key) + "\n")
+			}
+		}
+	}
+	return buf.String()
+}
+
+// repeatedKeysConfig repeats keys inside sections, the lists adding up
+const repeatedKeysConfig = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+OnUp = echo up
+OnUp = echo still up
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+AllowedIPs = 10.5.0.0/24
+AllowedIPs = 10.6.0.0/24, 10.7.0.0/24`
+
+func TestConfigFormatsWithINIFixtures(t *testing.T) {
+	fixtures := map[string]string{
+		"awgParams":       awgParamsConfig,
+		"namedDevices":    namedDevicesConfig,
+		"weightedBalance": weightedBalanceConfig,
+		"formats":         formatsConfig,
+		"amnezia":         amneziaExpected,
+		"repeatedKeys":    repeatedKeysConfig,
+	}
+	for name, fixture := range fixtures {
+		expected, err := ParseConfigStringAs(fixture, FormatINI)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		for _, format := range []string{FormatYAML, FormatJSON} {
+			config := convertINI(t, fixture, format)
+			conf, err := ParseConfigStringAs(config, format)
+			if err != nil {
+				t.Fatalf("%s as %s: %v\n%s", name, format, err, config)
+			}
+			if !reflect.DeepEqual(conf, expected) {
+				t.Errorf("%s as %s differs from the INI configuration\n%s", name, format, config)
+			}
+		}
+	}
+
+	conf, err := ParseConfigString(repeatedKeysConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Device.OnUp) != 2 || len(conf.Device.Peers[0].AllowedIPs) != 3 {
+		t.Errorf("repeated keys not added up: %v %v", conf.Device.OnUp, conf.Device.Peers[0].AllowedIPs)
+	}
+}
+
+func TestConfigFormatsWithHooks(t *testing.T) {
+	conf, err := ParseConfigStringAs(`
+Interface:
+  PrivateKey: LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+  Address: 10.5.0.2
+  OnUp:
+    - logger "wireproxy up"
+    - touch /tmp/wireproxy-up
+    - echo up
+  OnDown: [logger "wireproxy down", rm -f /tmp/wireproxy-up]
+`, FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Device.OnUp) != 3 || conf.Device.OnUp[1] != "touch /tmp/wireproxy-up" {
+		t.Errorf("unexpected OnUp hooks: %v", conf.Device.OnUp)
+	}
+	if len(conf.Device.OnDown) != 2 {
+		t.Errorf("unexpected OnDown hooks: %v", conf.Device.OnDown)
+	}
+}
+
+func TestConfigFormatsWithTrailingData(t *testing.T) {
+	for _, config := range []string{
+		`{"Interface": {"PrivateKey": "LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0="}} {"Socks5": {}}`,
+		`{"Interface": {"PrivateKey": "LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0="}} garbage`,
+	} {
+		_, err := ParseConfigStringAs(config, FormatJSON)
+		if err == nil {
+			t.Errorf("error expected for %s", config)
+		}
+	}
+}
+
+func TestConfigFormat(t *testing.T) {
+	for path, format := range map[string]string{
+		"/etc/wireproxy/wireproxy.conf": FormatINI,
+		"wireproxy.yaml":                FormatYAML,
+		"wireproxy.YML":                 FormatYAML,
+		"wireproxy.json":                FormatJSON,
+	} {
+		if ConfigFormat(path) != format {
+			t.Errorf("%s should be detected as %s, got %s", path, format, ConfigFormat(path))
+		}
+	}
+}
+
+func TestConfigMarshalINIRoundTrip(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(usersFile, []byte("alice:$2y$05$abcdefghijklmnopqrstuu5s2v8.iIieOjDRmkLx0QbY.BjHtMgtu\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2, fd00::2
+DNS = 1.1.1.1, example.com
+MTU = 1280
+ListenPort = 51820
+CheckAlive = 1.1.1.1
+CheckAliveInterval = 10
+RestartThreshold = 3
+Jc = 5
+Jmin = 10
+Jmax = 50
+S1 = 0
+S2 = 0
+H1 = 1
+H2 = 2
+H3 = 3
+H4 = 4
+I1 = <b 0xA1B2C3D4E5F6><r 16>
+OnUp = logger "wireproxy up"
+OnUp = touch /tmp/wireproxy-up
+OnHealthChange = echo $WIREPROXY_HEALTHY
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+PreSharedKey = UItQuvLsyh50ucXHfjF0bbR4IIpVBd74lwKc8uIPXXs=
+AllowedIPs = 0.0.0.0/0, ::/0
+Endpoint = 94.140.11.15:51820
+PersistentKeepalive = 25
+
+[Interface.home]
+PrivateKey = mBsVDahr1XIu9PPd17UmsDdB6E53nvmS47NbNqQCiFM=
+Address = 100.96.0.190
+
+[Peer.home]
+PublicKey = SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=
+Endpoint = 192.200.144.22:51820
+
+[Rule]
+Domain = example.org
+CIDR = 10.0.0.0/8
+Port = 80, 8000-8080
+Action = home
+
+[User]
+Name = peter
+Domain = example.com
+Port = 443
+MaxConnections = 4
+Bandwidth = 512K
+MonthlyQuota = 100G
+
+[Socks5]
+BindAddress = 127.0.0.1:25344
+Username = peter
+Password = $$notanenv
+
+[http]
+BindAddress = 127.0.0.1:25345
+Device = home
+Username = peter
+Password = \file:not-a-secret-reference
+AllowFrom = 127.0.0.1/8, 192.168.1.0/24, ::1
+
+[Mixed]
+BindAddress = 127.0.0.1:25346
+UsersFile = ` + usersFile + `
+
+[TransparentTCP]
+BindAddress = 0.0.0.0:12345
+TProxy = true
+Device = home
+
+[SNIProxy]
+BindAddress = 127.0.0.1:8443
+Domain = example.com
+Port = 443, 8080
+TargetPort = 443
+
+[PAC]
+Host = proxy.lan
+Domain = example.com
+CIDR = 10.0.0.0/8
+`
+	conf, err := ParseConfigString(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	marshaled, err := conf.MarshalINI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseConfigString(string(marshaled))
+	if err != nil {
+		t.Fatalf("%v\n%s", err, marshaled)
+	}
+	if !reflect.DeepEqual(parsed, conf) {
+		t.Errorf("configuration changed after a round trip:\n%s", marshaled)
+	}
+}
+
+func TestConfigMarshalResolvedEndpoints(t *testing.T) {
+	conf, err := ParseConfigString(`
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = vpn.example.com:51820
+
+[Peer]
+PublicKey = SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=
+Endpoint = _wireguard._udp.example.com`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The endpoints are replaced by their resolved addresses once the device starts
+	peers := conf.Device.Peers
+	peers[0].setEndpointCandidates("vpn.example.com", []netip.AddrPort{netip.MustParseAddrPort("192.0.2.1:51820")})
+	peers[1].setEndpointCandidates("_wireguard._udp.example.com", []netip.AddrPort{netip.MustParseAddrPort("192.0.2.2:51821")})
+
+	marshaled, err := conf.MarshalINI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseConfigString(string(marshaled))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, endpoint := range []string{"vpn.example.com:51820", "_wireguard._udp.example.com"} {
+		if *parsed.Device.Peers[i].Endpoint != endpoint {
+			t.Errorf("configured endpoint %s not marshaled:\n%s", endpoint, marshaled)
+		}
+	}
+}
+
+func TestDeviceMarshalWGQuick(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+DNS = 1.1.1.1
+CheckAlive = 1.1.1.1
+Jc = 5
+Jmin = 10
+Jmax = 50
+S1 = 0
+S2 = 0
+H1 = 1
+H2 = 2
+H3 = 3
+H4 = 4
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+AllowedIPs = 0.0.0.0/0
+Endpoint = 94.140.11.15:51820`
+	conf, err := ParseConfigString(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	marshaled, err := conf.Device.MarshalWGQuick()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const expected = `[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+DNS = 1.1.1.1
+MTU = 1420
+Jc = 5
+Jmin = 10
+Jmax = 50
+S1 = 0
+S2 = 0
+H1 = 1
+H2 = 2
+H3 = 3
+H4 = 4
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = 94.140.11.15:51820
+AllowedIPs = 0.0.0.0/0
+`
+	if string(marshaled) != expected {
+		t.Errorf("unexpected wg-quick export:\n%s", marshaled)
+	}
+
+	var device DeviceConfig
+	iniData, err := loadIniConfig(string(marshaled))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ParseInterface(iniData, &device); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(device.ASecConfig, conf.Device.ASecConfig) {
+		t.Error("AWG parameters changed after a round trip")
+	}
+}
+
+const amneziaLastConfig = `{
+	"H1": "1234", "H2": "5678", "H3": "9012", "H4": "3456",
+	"Jc": "4", "Jmin": "10", "Jmax": "50", "S1": "20", "S2": "30",
+	"I1": "<b 0xf6ab3267>",
+	"client_ip": "10.8.1.2",
+	"client_priv_key": "LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=",
+	"hostName": "203.0.113.7",
+	"port": 51820,
+	"psk_key": "UItQuvLsyh50ucXHfjF0bbR4IIpVBd74lwKc8uIPXXs=",
+	"server_pub_key": "e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=",
+	"mtu": "1376",
+	"persistent_keep_alive": "25",
+	"allowed_ips": ["0.0.0.0/0", "::/0"]
+}`
+
+const amneziaExpected = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.8.1.2
+DNS = 1.1.1.1, 1.0.0.1
+MTU = 1376
+Jc = 4
+Jmin = 10
+Jmax = 50
+S1 = 20
+S2 = 30
+H1 = 1234
+H2 = 5678
+H3 = 9012
+H4 = 3456
+I1 = <b 0xf6ab3267>
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+PreSharedKey = UItQuvLsyh50ucXHfjF0bbR4IIpVBd74lwKc8uIPXXs=
+Endpoint = 203.0.113.7:51820
+PersistentKeepalive = 25
+AllowedIPs = 0.0.0.0/0, ::/0`
+
+func amneziaLink(t *testing.T) string {
+	doc, err := json.Marshal(map[string]any{
+		"containers": []any{map[string]any{
+			"container": "amnezia-awg",
+			"awg": map[string]any{
+				"last_config":     amneziaLastConfig,
+				"port":            "51820",
+				"transport_proto": "udp",
+			},
+		}},
+		"defaultContainer": "amnezia-awg",
+		"description":      "Server",
+		"dns1":             "1.1.1.1",
+		"dns2":             "1.0.0.1",
+		"hostName":         "203.0.113.7",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encodeAmneziaLink(doc)
+}
+
+// encodeAmneziaLink returns the vpn:// link of doc
+func encodeAmneziaLink(doc []byte) string {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(doc)))
+	w := zlib.NewWriter(&buf)
+	_, _ = w.Write(doc)
+	_ = w.Close()
+	return "vpn://" + base64.RawURLEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestAmneziaConfig(t *testing.T) {
+	expected, err := ParseConfigString(amneziaExpected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device, err := ParseAmneziaConfig(amneziaLink(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(device, expected.Device) {
+		t.Errorf("vpn link parsed as %+v, expected %+v", device, expected.Device)
+	}
+
+	device, err = ParseAmneziaConfig(amneziaLastConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.MTU != 1376 || device.ASecConfig == nil || len(device.DNS) != 0 {
+		t.Errorf("unexpected device parsed from last_config: %+v", device)
+	}
+}
+
+func TestConfigWithAmneziaLink(t *testing.T) {
+	config := "WGConfig = " + amneziaLink(t) + `
+
+[Socks5]
+BindAddress = 127.0.0.1:25344`
+	conf, err := ParseConfigString(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.Device.Name != "203-0-113-7" || conf.Device.ASecConfig.junkPacketCount != 4 {
+		t.Errorf("unexpected device: %+v", conf.Device)
+	}
+
+	// The device name is a valid section name, so the configuration can be marshaled and read back
+	data, err := conf.MarshalINI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err = ParseConfigString(string(data))
+	if err != nil {
+		t.Fatalf("%v\n%s", err, data)
+	}
+	if conf.Device.Name != "203-0-113-7" || conf.Device.ASecConfig.junkPacketCount != 4 {
+		t.Errorf("unexpected device read back: %+v", conf.Device)
+	}
+}
+
+func TestAmneziaConfigWithSecretReference(t *testing.T) {
+	dir := t.TempDir()
+	for _, key := range []string{"exec:touch " + filepath.Join(dir, "PWNED"), "file:/etc/hostname", "$HOME"} {
+		doc, err := json.Marshal(map[string]any{
+			"client_priv_key": key,
+			"client_ip":       "10.8.1.2",
+			"server_pub_key":  "e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ParseAmneziaConfig(encodeAmneziaLink(doc)); err == nil {
+			t.Errorf("%s: error expected", key)
+		}
+		if _, err := ParseAmneziaConfig(string(doc)); err == nil {
+			t.Errorf("%s: error expected", key)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "PWNED")); err == nil {
+		t.Error("the command of the imported configuration ran")
+	}
+}
+
+func TestAmneziaConfigWithInvalidLink(t *testing.T) {
+	if _, err := ParseAmneziaConfig("vpn://not-a-link"); err == nil {
+		t.Error("error expected")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+DNS = 1.1.1.1
+Passwrod = secret
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+AllowedIPs = 10.0.0.0/8
+Endpoint = 94.140.11.15:51820
+
+[Sock5]
+BindAddress = 127.0.0.1:25344
+`
+	diagnostics := ValidateConfigString(config, "test.conf")
+
+	expected := []string{
+		"test.conf:6: unknown key Passwrod in [Interface]",
+		"test.conf:13: unknown section [Sock5]",
+	}
+	if len(diagnostics) != len(expected) {
+		t.Fatalf("unexpected diagnostics: %v", diagnostics)
+	}
+	for i, diagnostic := range diagnostics {
+		if diagnostic.String() != expected[i] {
+			t.Errorf("got %q, expected %q", diagnostic, expected[i])
+		}
+	}
+}
+
+func TestValidateConfigConflicts(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+AllowedIPs = 10.0.0.0/8
+
+[Peer]
+PublicKey = SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=
+AllowedIPs = 10.1.0.0/16
+
+[Socks5]
+BindAddress = 127.0.0.1:25344
+
+[http]
+BindAddress = 0.0.0.0:25344
+
+[Rule]
+Domain = example.com
+Action = tunnel
+`
+	diagnostics := ValidateConfigString(config, "test.conf")
+
+	expected := []string{
+		"test.conf:12: AllowedIPs 10.1.0.0/16 overlaps with the peer at line 6",
+		"test.conf:14: [Socks5]: device [Interface] has no DNS server to resolve host names",
+		"test.conf:17: [http]: device [Interface] has no DNS server to resolve host names",
+		"test.conf:18: BindAddress 0.0.0.0:25344 collides with [Socks5] at line 14",
+	}
+	if len(diagnostics) != len(expected) {
+		t.Fatalf("unexpected diagnostics: %v", diagnostics)
+	}
+	for i, diagnostic := range diagnostics {
+		if diagnostic.String() != expected[i] {
+			t.Errorf("got %q, expected %q", diagnostic, expected[i])
+		}
+	}
+}
+
+func TestValidateConfigWithIncludedFiles(t *testing.T) {
+	dir := t.TempDir()
+	device := filepath.Join(dir, "device.conf")
+	err := os.WriteFile(device, []byte(`[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+MTUU = 1420
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+AllowedIPs = 0.0.0.0/0
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "proxies.conf"), []byte(`
+[http]
+BindAddress = 127.0.0.1:25344
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := `WGConfig = ` + device + `
+Include = proxies.conf
+
+[Socks5]
+BindAddress = 127.0.0.1:25344
+`
+	main := filepath.Join(dir, "wireproxy.conf")
+
+	expected := []string{
+		device + ":4: unknown key MTUU in [Interface]",
+	}
+	diagnostics := ValidateConfigString(config, main)
+	if len(diagnostics) != len(expected) {
+		t.Fatalf("unexpected diagnostics: %v", diagnostics)
+	}
+	for i, diagnostic := range diagnostics {
+		if diagnostic.String() != expected[i] {
+			t.Errorf("got %q, expected %q", diagnostic, expected[i])
+		}
+	}
+
+	// Without a Domain target, a device without DNS server is fine
+	err = os.WriteFile(device, []byte(`[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+AllowedIPs = 0.0.0.0/0
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = []string{
+		filepath.Join(dir, "proxies.conf") + ":3: BindAddress 127.0.0.1:25344 collides with [Socks5] at " + main + ":4",
+	}
+	diagnostics = ValidateConfigString(config, main)
+	if len(diagnostics) != len(expected) {
+		t.Fatalf("unexpected diagnostics: %v", diagnostics)
+	}
+	for i, diagnostic := range diagnostics {
+		if diagnostic.String() != expected[i] {
+			t.Errorf("got %q, expected %q", diagnostic, expected[i])
+		}
+	}
+}
+
+func TestValidateConfigWithWGQuickFile(t *testing.T) {
+	device := filepath.Join(t.TempDir(), "wg0.conf")
+	err := os.WriteFile(device, []byte(`[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+Table = off
+SaveConfig = false
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+PreDown = iptables -D FORWARD -i %i -j ACCEPT
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+AllowedIPs = 0.0.0.0/0
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diagnostics := ValidateConfigString("WGConfig = "+device, "wireproxy.conf")
+	if len(diagnostics) != 0 {
+		t.Errorf("unexpected diagnostics: %v", diagnostics)
+	}
+}
+
+func TestValidateConfigWithInvalidKey(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Interface]
+PrivateKey = notbase64
+`
+	diagnostics := ValidateConfigString(config, "test.conf")
+	if len(diagnostics) != 1 || diagnostics[0].Line != 6 {
+		t.Errorf("unexpected diagnostics: %v", diagnostics)
+	}
+}
+
+func TestWireguardConfWithAWGHeadersAndPackets(t *testing.T) {
+	tests := []struct {
+		params        string
+		expectedError string
+	}{
+		{"H1 = 100-199\nH2 = 200-299\nH3 = 300\nH4 = 400-499", ""},
+		{"H1 = 1\nH2 = 2\nH3 = 3\nH4 = 4", ""},
+		{"H1 = 100-200\nH2 = 150-250", "ranges of the H1 and H2 fields must not overlap"},
+		{"H1 = 200-100", "range of the H1 field must not end before it starts: 200-100"},
+		{"H2 = abc", "value of the H2 field must be a number or a min-max range: abc"},
+		{"H1 = 100\nH4 = 1-10", "value of the H4 field must not include the WireGuard message type 1"},
+		{"I1 = <b 0xf6ab3267fa><r 16><rc 8><rd 4><t>", ""},
+		{"I1 = <b 0xf6ab3>", "value of the I1 field has an invalid tag <b 0xf6ab3>: bytes expected as hexadecimal with an even number of digits"},
+		{"I2 = <r>", "value of the I2 field has an invalid tag <r>: positive length expected"},
+		{"I3 = <t 5>", "value of the I3 field has an invalid tag <t 5>: no argument expected"},
+		{"I1 = <x 1>", "value of the I1 field has an invalid tag <x 1>: unknown tag"},
+		{"I1 = <b 0x01", "value of the I1 field is missing the closing > of <b 0x01"},
+		{"I1 = abc<t>", "value of the I1 field has unexpected text outside of a tag: abc<t>"},
+	}
+
+	for _, test := range tests {
+		config := `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+Jc = 5
+Jmin = 10
+Jmax = 50
+S1 = 0
+S2 = 0
+` + test.params
+		var cfg DeviceConfig
+		iniData, err := loadIniConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ParseInterface(iniData, &cfg)
+		if test.expectedError == "" {
+			if err != nil {
+				t.Errorf("%q: %v", test.params, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.expectedError {
+			t.Errorf("%q: error expected: %s, got: %v", test.params, test.expectedError, err)
+		}
+	}
+}
+
+func TestWireguardConfWithSpacedAWGHeaderRange(t *testing.T) {
+	config := `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+H1 = 100 - 199
+H2 = 200`
+	var cfg DeviceConfig
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ParseInterface(iniData, &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	setting, err := CreateIPCRequest(&cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(setting.IpcRequest, "h1=100-199\n") || !strings.Contains(setting.IpcRequest, "h2=200\n") {
+		t.Errorf("magic headers not normalized in the IPC request:\n%s", setting.IpcRequest)
+	}
+}
+
+func TestGenerateASecConfig(t *testing.T) {
+	for _, mimic := range []string{"", MimicQUIC, MimicDNS, MimicSIP} {
+		for i := 0; i < 50; i++ {
+			generated, err := GenerateASecConfig(ASecGenerateOptions{HeaderRanges: i%2 == 0, Mimic: mimic})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			iniData, err := loadIniConfig(string(generated.MarshalClientINI()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := ParseASecConfig(iniData.Section("Interface"))
+			if err != nil {
+				t.Fatalf("%v\n%s", err, generated.MarshalClientINI())
+			}
+			if !reflect.DeepEqual(parsed, generated) {
+				t.Fatalf("generated parameters changed after a round trip:\n%s", generated.MarshalClientINI())
+			}
+		}
+	}
+
+	if _, err := GenerateASecConfig(ASecGenerateOptions{Mimic: "ftp"}); err == nil {
+		t.Error("error expected")
+	}
+}
+
+func TestConfigWithSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	privateKey := filepath.Join(dir, "private-key")
+	if err := os.WriteFile(privateKey, []byte("LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	password := filepath.Join(dir, "password")
+	if err := os.WriteFile(password, []byte("secret\n"), 0o400); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CREDENTIALS_DIRECTORY", dir)
+
+	config := `
+[Interface]
+PrivateKeyFile = $CREDENTIALS_DIRECTORY/private-key
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+PreSharedKey = exec:echo UItQuvLsyh50ucXHfjF0bbR4IIpVBd74lwKc8uIPXXs=
+
+[Socks5]
+BindAddress = 127.0.0.1:25344
+Username = peter
+Password = file:` + password + `
+
+[http]
+BindAddress = 127.0.0.1:25345
+PasswordFile = ` + password
+	conf, err := ParseConfigString(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.Device.SecretKey != "2c0af568d48d17d774323c14800542e34db44f437f139354b6a56fe449ec4b3d" {
+		t.Errorf("unexpected private key: %s", conf.Device.SecretKey)
+	}
+	if conf.Device.Peers[0].PreSharedKey != "508b50baf2ecca1e74b9c5c77e31746db478208a5505def897029cf2e20f5d7b" {
+		t.Errorf("unexpected preshared key: %s", conf.Device.Peers[0].PreSharedKey)
+	}
+	if conf.Routines[0].(*Socks5Config).Password != "secret" || conf.Routines[1].(*HTTPConfig).Password != "secret" {
+		t.Error("unexpected password")
+	}
+}
+
+func TestConfigWithWorldReadableSecretFile(t *testing.T) {
+	privateKey := filepath.Join(t.TempDir(), "private-key")
+	if err := os.WriteFile(privateKey, []byte("LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0="), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := `
+[Interface]
+PrivateKeyFile = ` + privateKey + `
+Address = 10.5.0.2`
+	_, err := ParseConfigString(config)
+	if err == nil {
+		t.Fatal("error expected")
+	}
+	expectedError := "secret file " + privateKey + " must not be readable by other users"
+	if err.Error() != expectedError {
+		t.Fatalf("error expected: %s, got: %s", expectedError, err.Error())
+	}
+}
+
+func TestConfigWithSecretAndSecretFile(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+PrivateKeyFile = /run/secrets/private-key
+Address = 10.5.0.2`
+	if _, err := ParseConfigString(config); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestConfigWithInclude(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "conf.d"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"wireproxy.conf": `
+Include = conf.d/*.conf
+
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Socks5]
+BindAddress = 127.0.0.1:25344`,
+		"conf.d/10-http.conf": `
+[http]
+BindAddress = 127.0.0.1:25345`,
+		"conf.d/20-rules.conf": `
+Include = ../extra.yaml
+
+[Rule]
+Domain = example.org
+Action = direct`,
+		"extra.yaml": `
+Socks5:
+  BindAddress: 127.0.0.1:25346`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf, err := ParseConfig(filepath.Join(dir, "wireproxy.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(conf.Routines) != 3 || len(conf.Rules) != 1 {
+		t.Fatalf("unexpected routines %v and rules %v", conf.Routines, conf.Rules)
+	}
+	if conf.Routines[1].(*HTTPConfig).BindAddress != "127.0.0.1:25345" ||
+		conf.Routines[2].(*Socks5Config).BindAddress != "127.0.0.1:25346" {
+		t.Errorf("unexpected routines: %v", conf.Routines)
+	}
+}
+
+func TestConfigWithIncludeLoop(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"wireproxy.conf": `
+Include = a.conf
+
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2`,
+		"a.conf": "Include = b.conf",
+		"b.conf": "Include = a.conf",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := ParseConfig(filepath.Join(dir, "wireproxy.conf"))
+	if err == nil {
+		t.Fatal("error expected")
+	}
+	a, b := filepath.Join(dir, "a.conf"), filepath.Join(dir, "b.conf")
+	expectedError := "include loop: " + a + " -> " + b + " -> " + a
+	if err.Error() != expectedError {
+		t.Fatalf("error expected: %s, got: %s", expectedError, err.Error())
+	}
+}
+
+func TestConfigWithInvalidInclude(t *testing.T) {
+	dir := t.TempDir()
+	included := filepath.Join(dir, "socks.conf")
+	if err := os.WriteFile(included, []byte("[Socks5]\nWeights = 1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := `
+Include = ` + included + `
+
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2`
+	_, err := ParseConfigString(config)
+	if err == nil {
+		t.Fatal("error expected")
+	}
+	if !strings.HasPrefix(err.Error(), included+": ") {
+		t.Fatalf("error should point at %s, got: %s", included, err.Error())
+	}
+}
+
+func TestConfigWithIncludedSections(t *testing.T) {
+	dir := t.TempDir()
+	for _, section := range []string{"PAC", "TCPClientTunnel", "Interface", "Peer.home", "Socks"} {
+		included := filepath.Join(dir, section+".conf")
+		if err := os.WriteFile(included, []byte("["+section+"]\nBindAddress = 127.0.0.1:8080"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		config := `
+Include = ` + included + `
+
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2`
+		_, err := ParseConfigString(config)
+		if err == nil || !strings.Contains(err.Error(), "cannot be set in an included file") {
+			t.Errorf("[%s] should be rejected in an included file, got: %v", section, err)
+		}
+	}
+}
+
+func TestCheckAliveIntervalTooSmall(t *testing.T) {
+	_, err := ParseConfigString(`
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+CheckAlive = 1.1.1.1
+CheckAliveInterval = 0`)
+	if err == nil {
+		t.Error("error expected")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/amnezia-vpn/amneziawg-go/tun/netstack"
 	"github.com/miekg/dns"
 )
 
@@ -19,11 +20,15 @@ type TUNResolver struct {
 // Resolve resolves a hostname using DNS over the virtual tunnel interface.
 // It prefers IPv4 (A records), but falls back to IPv6 (AAAA) if no A is found.
 func (r *TUNResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
-	if r.vt == nil || len(r.vt.Conf.DNS) == 0 {
+	if r.vt == nil {
+		return ctx, nil, errors.New("no DNS servers configured")
+	}
+	vt := r.vt.Active()
+	if len(vt.Conf.DNS) == 0 {
 		return ctx, nil, errors.New("no DNS servers configured")
 	}
 
-	dnsServer := r.vt.Conf.DNS[0].String()
+	dnsServer := vt.Conf.DNS[0].String()
 	if !strings.Contains(dnsServer, ":") {
 		dnsServer += ":53"
 	}
@@ -36,8 +41,8 @@ func (r *TUNResolver) Resolve(ctx context.Context, name string) (context.Context
 
 	// List of names to try: original + appended search domains if unqualified
 	var namesToQuery []string
-	if strings.Count(strings.TrimSuffix(originalName, "."), ".") == 0 && len(r.vt.Conf.SearchDomains) > 0 {
-		for _, domain := range r.vt.Conf.SearchDomains {
+	if strings.Count(strings.TrimSuffix(originalName, "."), ".") == 0 && len(vt.Conf.SearchDomains) > 0 {
+		for _, domain := range vt.Conf.SearchDomains {
 			full := strings.TrimSuffix(originalName, ".") + "." + strings.TrimPrefix(domain, ".") + "."
 			namesToQuery = append(namesToQuery, full)
 		}
@@ -46,7 +51,7 @@ func (r *TUNResolver) Resolve(ctx context.Context, name string) (context.Context
 
 	// Prefer A (IPv4)
 	for _, qname := range namesToQuery {
-		ip, err := r.queryDNS(ctx, dnsServer, qname, dns.TypeA)
+		ip, err := queryDNS(ctx, vt.currentNet(), dnsServer, qname, dns.TypeA)
 		if err == nil && ip != nil {
 			return ctx, ip, nil
 		}
@@ -54,7 +59,7 @@ func (r *TUNResolver) Resolve(ctx context.Context, name string) (context.Context
 
 	// Fallback to AAAA (IPv6)
 	for _, qname := range namesToQuery {
-		ip, err := r.queryDNS(ctx, dnsServer, qname, dns.TypeAAAA)
+		ip, err := queryDNS(ctx, vt.currentNet(), dnsServer, qname, dns.TypeAAAA)
 		if err == nil && ip != nil {
 			return ctx, ip, nil
 		}
@@ -64,8 +69,8 @@ func (r *TUNResolver) Resolve(ctx context.Context, name string) (context.Context
 }
 
 // queryDNS sends a DNS query of the specified type and returns the first matching IP.
-func (r *TUNResolver) queryDNS(ctx context.Context, dnsServer, name string, qtype uint16) (net.IP, error) {
-	conn, err := r.vt.Tnet.DialContext(ctx, "udp", dnsServer)
+func queryDNS(ctx context.Context, tnet *netstack.Net, dnsServer, name string, qtype uint16) (net.IP, error) {
+	conn, err := tnet.DialContext(ctx, "udp", dnsServer)
 	if err != nil {
 		return nil, err
 	}
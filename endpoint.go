@@ -0,0 +1,185 @@
+package wireproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+// endpointRotationInterval is the minimum time between two rotations of the endpoints of a device,
+// as a failed handshake is usually reported several times in a row
+const endpointRotationInterval = 10 * time.Second
+
+// isSRVName reports whether host is an SRV record name such as _wireguard._udp.example.com
+func isSRVName(host string) bool {
+	return strings.HasPrefix(host, "_")
+}
+
+// lookupEndpoint resolves host on the host network into the candidate addresses of an endpoint.
+// SRV names, given without port, are resolved into the addresses of their targets in the order
+// of the records, and other host names into all of their addresses with the given port.
+func lookupEndpoint(ctx context.Context, host, port string) ([]netip.AddrPort, error) {
+	resolver := net.DefaultResolver
+
+	if port == "" && isSRVName(host) {
+		_, records, err := resolver.LookupSRV(ctx, "", "", host)
+		if err != nil {
+			return nil, err
+		}
+
+		var candidates []netip.AddrPort
+		for _, record := range records {
+			addrs, err := resolver.LookupNetIP(ctx, "ip", strings.TrimSuffix(record.Target, "."))
+			if err != nil {
+				continue
+			}
+			for _, addr := range addrs {
+				candidates = append(candidates, netip.AddrPortFrom(addr.Unmap(), record.Port))
+			}
+		}
+		if len(candidates) == 0 {
+			return nil, errors.New("no addresses found for the targets of endpoint " + host)
+		}
+		return candidates, nil
+	}
+
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port of endpoint %s: %s", host, port)
+	}
+
+	addrs, err := resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses found for endpoint " + host)
+	}
+
+	candidates := make([]netip.AddrPort, 0, len(addrs))
+	for _, addr := range addrs {
+		candidates = append(candidates, netip.AddrPortFrom(addr.Unmap(), uint16(portNumber)))
+	}
+	return candidates, nil
+}
+
+// setEndpointCandidates replaces the candidate addresses of the endpoint, resolved from host.
+// The current endpoint is kept when it is still a candidate, the first candidate is used otherwise.
+func (p *PeerConfig) setEndpointCandidates(host string, candidates []netip.AddrPort) {
+	p.hostname = host
+
+	current := 0
+	for i, candidate := range candidates {
+		if p.Endpoint != nil && candidate.String() == *p.Endpoint {
+			current = i
+			break
+		}
+	}
+
+	p.candidates = candidates
+	p.candidate = current
+	endpoint := candidates[current].String()
+	p.Endpoint = &endpoint
+}
+
+// configuredEndpoint returns the endpoint as it was configured, before its hostname or SRV
+// name was replaced by a resolved address
+func (p *PeerConfig) configuredEndpoint() string {
+	switch {
+	case p.hostname == "":
+		return *p.Endpoint
+	case isSRVName(p.hostname):
+		return p.hostname
+	}
+	_, port, err := net.SplitHostPort(*p.Endpoint)
+	if err != nil {
+		return *p.Endpoint
+	}
+	return net.JoinHostPort(p.hostname, port)
+}
+
+// nextEndpoint switches the endpoint to the next candidate address, reporting whether there was one
+func (p *PeerConfig) nextEndpoint() bool {
+	if len(p.candidates) < 2 {
+		return false
+	}
+	p.candidate = (p.candidate + 1) % len(p.candidates)
+	endpoint := p.candidates[p.candidate].String()
+	p.Endpoint = &endpoint
+	return true
+}
+
+// peerHandshakes returns the time of the last handshake of every peer of the device by
+// public key, zero for the peers that never completed one
+func (d *VirtualTun) peerHandshakes() (map[string]time.Time, error) {
+	dev := d.currentDevice()
+	if dev == nil {
+		return nil, errors.New("device not started")
+	}
+	get, err := dev.IpcGet()
+	if err != nil {
+		return nil, err
+	}
+
+	handshakes := make(map[string]time.Time)
+	var publicKey string
+	scanner := bufio.NewScanner(strings.NewReader(get))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		switch key {
+		case "public_key":
+			publicKey = value
+			handshakes[publicKey] = time.Time{}
+		case "last_handshake_time_sec":
+			if sec, err := strconv.ParseInt(value, 10, 64); err == nil && sec != 0 {
+				handshakes[publicKey] = time.Unix(sec, 0)
+			}
+		}
+	}
+	return handshakes, nil
+}
+
+// rotateEndpoints moves the peers resolved into several addresses to their next candidate,
+// after handshakes stopped succeeding. The peers whose session is still valid are left alone.
+func (d *VirtualTun) rotateEndpoints() {
+	now := time.Now().UnixNano()
+	last := d.lastRotation.Load()
+	if now-last < int64(endpointRotationInterval) || !d.lastRotation.CompareAndSwap(last, now) {
+		return
+	}
+
+	handshakes, err := d.peerHandshakes()
+	if err != nil {
+		d.Logger.Errorf("Failed to read peer handshakes: %v", err)
+		return
+	}
+
+	d.Conf.endpointLock.Lock()
+	defer d.Conf.endpointLock.Unlock()
+
+	var request strings.Builder
+	for i := range d.Conf.Peers {
+		peer := &d.Conf.Peers[i]
+		if len(peer.candidates) < 2 || time.Since(handshakes[peer.PublicKey]) < device.RejectAfterTime {
+			continue
+		}
+		previous := *peer.Endpoint
+		peer.nextEndpoint()
+		d.Logger.Verbosef("Handshake with %s failed, switching peer endpoint to %s", previous, *peer.Endpoint)
+		request.WriteString(fmt.Sprintf("public_key=%s\nupdate_only=true\nendpoint=%s\n", peer.PublicKey, *peer.Endpoint))
+	}
+
+	if request.Len() > 0 {
+		if err := d.currentDevice().IpcSet(request.String()); err != nil {
+			d.Logger.Errorf("Failed to switch peer endpoints: %v", err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package wireproxy
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+func TestPeerEndpointCandidates(t *testing.T) {
+	srv := "_wireguard._udp.example.com"
+	peer := PeerConfig{Endpoint: &srv}
+	if !peer.NeedsResolution() {
+		t.Error("SRV endpoints need resolution")
+	}
+
+	candidates := []netip.AddrPort{
+		netip.MustParseAddrPort("192.0.2.1:51820"),
+		netip.MustParseAddrPort("[2001:db8::1]:51820"),
+		netip.MustParseAddrPort("192.0.2.2:51821"),
+	}
+	peer.setEndpointCandidates(srv, candidates)
+	if *peer.Endpoint != "192.0.2.1:51820" {
+		t.Errorf("unexpected endpoint: %s", *peer.Endpoint)
+	}
+
+	for _, expected := range []string{"[2001:db8::1]:51820", "192.0.2.2:51821", "192.0.2.1:51820"} {
+		if !peer.nextEndpoint() || *peer.Endpoint != expected {
+			t.Errorf("endpoint expected: %s, got: %s", expected, *peer.Endpoint)
+		}
+	}
+
+	// Resolving the endpoint again keeps the candidate in use
+	peer.nextEndpoint()
+	peer.setEndpointCandidates(srv, candidates)
+	if *peer.Endpoint != "[2001:db8::1]:51820" {
+		t.Errorf("unexpected endpoint after resolving again: %s", *peer.Endpoint)
+	}
+
+	peer.setEndpointCandidates(srv, candidates[:1])
+	if peer.nextEndpoint() {
+		t.Error("a single candidate cannot be rotated")
+	}
+}
+
+func TestRotateEndpoints(t *testing.T) {
+	conf, err := ParseConfigString(`
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+AllowedIPs = 10.5.0.1/32
+
+[Peer]
+PublicKey = QP+A67Z2UBrMgvNIdHv8gPel5URWNLS4B3ZQ2hQIZlg=
+Endpoint = 192.0.2.1:51820
+AllowedIPs = 10.5.0.3/32`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vt, err := StartWireguard(conf.Device, device.NewLogger(device.LogLevelSilent, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vt.Close()
+
+	peers := conf.Device.Peers
+	peers[1].setEndpointCandidates("example.com", []netip.AddrPort{
+		netip.MustParseAddrPort("192.0.2.1:51820"),
+		netip.MustParseAddrPort("192.0.2.2:51820"),
+	})
+
+	// The peer without endpoint is skipped, the one that never completed a handshake rotates
+	vt.rotateEndpoints()
+	if peers[0].Endpoint != nil || *peers[1].Endpoint != "192.0.2.2:51820" {
+		t.Errorf("unexpected endpoints after rotation: %v, %s", peers[0].Endpoint, *peers[1].Endpoint)
+	}
+}
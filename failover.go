@@ -0,0 +1,97 @@
+package wireproxy
+
+import (
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+// StartDevices starts every device of the configuration and returns the primary one,
+// with the remaining devices attached as its Standby tunnels in priority order
+// and the named devices as its Tunnels
+func StartDevices(conf *Configuration, logger *device.Logger) (*VirtualTun, error) {
+	started := make(map[*DeviceConfig]*VirtualTun)
+	start := func(deviceConf *DeviceConfig) (*VirtualTun, error) {
+		if vt, ok := started[deviceConf]; ok {
+			return vt, nil
+		}
+		vt, err := StartWireguard(deviceConf, logger)
+		if err != nil {
+			for _, vt := range started {
+				vt.Close()
+			}
+			return nil, err
+		}
+		started[deviceConf] = vt
+		return vt, nil
+	}
+
+	var tunnels []*VirtualTun
+	for _, deviceConf := range conf.Devices {
+		vt, err := start(deviceConf)
+		if err != nil {
+			return nil, err
+		}
+		tunnels = append(tunnels, vt)
+	}
+
+	primary := tunnels[0]
+	primary.Standby = tunnels[1:]
+	primary.Rules = conf.Rules
+	primary.Users = conf.Users
+	primary.PAC = conf.PAC
+	primary.Routines = conf.Routines
+	primary.Tunnels = make(map[string]*VirtualTun, len(conf.Tunnels))
+	for name, deviceConf := range conf.Tunnels {
+		vt, err := start(deviceConf)
+		if err != nil {
+			return nil, err
+		}
+		primary.Tunnels[name] = vt
+	}
+	return primary, nil
+}
+
+// CloseAll closes d along with its Standby and named Tunnels, running their OnDown hooks.
+// It is meant to be called when wireproxy shuts down.
+func (d *VirtualTun) CloseAll() {
+	d.Close()
+	for _, vt := range d.Standby {
+		vt.Close()
+	}
+	for _, vt := range d.Tunnels {
+		vt.Close()
+	}
+}
+
+// Healthy reports whether the tunnel answers its CheckAlive probes and
+// the last handshake attempt did not fail
+func (d *VirtualTun) Healthy() bool {
+	return !d.handshakeFailed.Load() && d.pingHealthy()
+}
+
+// Active returns the highest priority healthy tunnel among d and its Standby tunnels.
+// When none of them is healthy d itself is returned.
+func (d *VirtualTun) Active() *VirtualTun {
+	if len(d.Standby) == 0 {
+		return d
+	}
+
+	next := d
+	for _, vt := range append([]*VirtualTun{d}, d.Standby...) {
+		if vt.Healthy() {
+			next = vt
+			break
+		}
+	}
+
+	if prev := d.active.Swap(next); prev != nil && prev != next {
+		d.Logger.Verbosef("Failover: switching from device %q to %q", prev.Conf.Name, next.Conf.Name)
+	}
+	return next
+}
+
+func (d *VirtualTun) statusChanged(code device.StatusCode) {
+	d.handshakeFailed.Store(code == device.StatusHandshakeFailure)
+	if code == device.StatusHandshakeFailure {
+		go d.rotateEndpoints()
+	}
+}
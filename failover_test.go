@@ -0,0 +1,85 @@
+package wireproxy
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+func TestCloseAll(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are run with sh")
+	}
+
+	dir := t.TempDir()
+	var tunnels []*VirtualTun
+	for _, name := range []string{"primary", "standby"} {
+		conf, err := ParseConfigString(`
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+OnDown = touch ` + filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vt, err := StartWireguard(conf.Device, device.NewLogger(device.LogLevelSilent, ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tunnels = append(tunnels, vt)
+	}
+	tunnels[0].Standby = tunnels[1:]
+
+	tunnels[0].CloseAll()
+	for _, name := range []string{"primary", "standby"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("OnDown of %s did not run: %v", name, err)
+		}
+	}
+}
+
+func TestActive(t *testing.T) {
+	logger := device.NewLogger(device.LogLevelSilent, "")
+	var tunnels []*VirtualTun
+	for _, name := range []string{"primary", "first", "second"} {
+		tunnels = append(tunnels, &VirtualTun{
+			Conf:           &DeviceConfig{Name: name, CheckAliveInterval: 5},
+			Logger:         logger,
+			PingRecordLock: new(sync.Mutex),
+		})
+	}
+	primary, first, second := tunnels[0], tunnels[1], tunnels[2]
+	primary.Standby = []*VirtualTun{first, second}
+
+	if primary.Active() != primary {
+		t.Error("the healthy primary should be active")
+	}
+
+	// A failed handshake on the primary and a stale probe on the first standby
+	primary.handshakeFailed.Store(true)
+	first.PingRecord = map[string]uint64{"10.5.0.1": 0}
+	if primary.Active() != second {
+		t.Errorf("the first healthy standby should be active, got %s", primary.Active().Conf.Name)
+	}
+
+	first.PingRecord = nil
+	if primary.Active() != first {
+		t.Errorf("the standby order should be kept, got %s", primary.Active().Conf.Name)
+	}
+
+	primary.handshakeFailed.Store(false)
+	if primary.Active() != primary {
+		t.Errorf("the recovered primary should be active again, got %s", primary.Active().Conf.Name)
+	}
+
+	for _, vt := range tunnels {
+		vt.handshakeFailed.Store(true)
+	}
+	if primary.Active() != primary {
+		t.Errorf("the primary should be active when no tunnel is healthy, got %s", primary.Active().Conf.Name)
+	}
+}
@@ -0,0 +1,147 @@
+package wireproxy
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Events passed to the hooks in WIREPROXY_EVENT
+const (
+	HookUp           = "up"
+	HookDown         = "down"
+	HookHandshake    = "handshake"
+	HookHealthChange = "health"
+)
+
+const (
+	// hookTimeout bounds the time a hook command may take
+	hookTimeout = 30 * time.Second
+	// handshakePollInterval is how often the peers are checked for new handshakes
+	handshakePollInterval = 2 * time.Second
+)
+
+// runHooks runs the commands of a hook with a shell, with environment variables describing
+// the event, the device and, when known, the peer. peer is nil for device wide events.
+func (d *VirtualTun) runHooks(event string, commands []string, peer *PeerConfig, extraEnv ...string) {
+	if len(commands) == 0 {
+		return
+	}
+
+	env := append(os.Environ(),
+		"WIREPROXY_EVENT="+event,
+		"WIREPROXY_DEVICE="+d.Conf.Name,
+		"WIREPROXY_ADDRESS="+joinList(d.Conf.Address),
+	)
+	if peer == nil && len(d.Conf.Peers) == 1 {
+		peer = &d.Conf.Peers[0]
+	}
+	if peer != nil {
+		if publicKey, err := encodeHexToBase64(peer.PublicKey); err == nil {
+			env = append(env, "WIREPROXY_PEER_PUBLIC_KEY="+publicKey)
+		}
+		d.Conf.endpointLock.Lock()
+		if peer.Endpoint != nil {
+			env = append(env, "WIREPROXY_PEER_ENDPOINT="+*peer.Endpoint)
+		}
+		d.Conf.endpointLock.Unlock()
+	}
+	env = append(env, extraEnv...)
+
+	for _, command := range commands {
+		ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+		} else {
+			cmd = exec.CommandContext(ctx, "sh", "-c", command)
+		}
+		cmd.Env = env
+
+		output, err := cmd.CombinedOutput()
+		cancel()
+		if err != nil {
+			d.Logger.Errorf("Hook %s: %q failed: %v: %s", event, command, err, strings.TrimSpace(string(output)))
+		} else {
+			d.Logger.Verbosef("Hook %s: %q done", event, command)
+		}
+	}
+}
+
+// startHooks runs the OnUp hook and starts watching the events the other hooks wait for
+func (d *VirtualTun) startHooks() {
+	go d.runHooks(HookUp, d.Conf.OnUp, nil)
+
+	if len(d.Conf.OnHandshake) > 0 {
+		go d.watchHandshakes()
+	}
+	if len(d.Conf.OnHealthChange) > 0 {
+		go d.watchHealth()
+	}
+}
+
+// Close runs the OnDown hook and closes the device
+func (d *VirtualTun) Close() {
+	d.closeOnce.Do(func() {
+		close(d.closed)
+		d.runHooks(HookDown, d.Conf.OnDown, nil)
+		d.deviceLock.Lock()
+		defer d.deviceLock.Unlock()
+		d.Dev.Close()
+	})
+}
+
+// watchHandshakes runs the OnHandshake hook whenever a peer completes a handshake
+func (d *VirtualTun) watchHandshakes() {
+	lastHandshakes := make(map[string]time.Time)
+
+	ticker := time.NewTicker(handshakePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.closed:
+			return
+		case <-ticker.C:
+		}
+
+		handshakes, err := d.peerHandshakes()
+		if err != nil {
+			continue
+		}
+		for publicKey, handshake := range handshakes {
+			if handshake.IsZero() || lastHandshakes[publicKey].Equal(handshake) {
+				continue
+			}
+			lastHandshakes[publicKey] = handshake
+			for i := range d.Conf.Peers {
+				if d.Conf.Peers[i].PublicKey == publicKey {
+					go d.runHooks(HookHandshake, d.Conf.OnHandshake, &d.Conf.Peers[i])
+				}
+			}
+		}
+	}
+}
+
+// watchHealth runs the OnHealthChange hook whenever the tunnel becomes healthy or unhealthy
+func (d *VirtualTun) watchHealth() {
+	ticker := time.NewTicker(d.checkAliveInterval())
+	defer ticker.Stop()
+
+	healthy := d.Healthy()
+	for {
+		select {
+		case <-d.closed:
+			return
+		case <-ticker.C:
+		}
+
+		if now := d.Healthy(); now != healthy {
+			healthy = now
+			go d.runHooks(HookHealthChange, d.Conf.OnHealthChange, nil, "WIREPROXY_HEALTHY="+strconv.FormatBool(healthy))
+		}
+	}
+}
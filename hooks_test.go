@@ -0,0 +1,48 @@
+package wireproxy
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+func TestDeviceHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are run with sh")
+	}
+
+	output := filepath.Join(t.TempDir(), "hook")
+	config := `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+OnDown = echo "$WIREPROXY_EVENT $WIREPROXY_DEVICE $WIREPROXY_ADDRESS" > ` + output + `
+OnDown = echo "$WIREPROXY_PEER_PUBLIC_KEY $WIREPROXY_PEER_ENDPOINT" >> ` + output + `
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = 94.140.11.15:51820`
+	conf, err := ParseConfigString(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Device.Name = "home"
+	if len(conf.Device.OnDown) != 2 {
+		t.Fatalf("unexpected OnDown hooks: %v", conf.Device.OnDown)
+	}
+
+	vt := &VirtualTun{Conf: conf.Device, Logger: device.NewLogger(device.LogLevelSilent, "")}
+	vt.runHooks(HookDown, conf.Device.OnDown, nil)
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "down home 10.5.0.2\ne8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w= 94.140.11.15:51820\n"
+	if string(data) != expected {
+		t.Errorf("unexpected hook output: %q", data)
+	}
+}
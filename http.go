@@ -4,12 +4,14 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
 	"sync"
 
@@ -21,46 +23,90 @@ const proxyAuthHeaderKey = "Proxy-Authorization"
 type HTTPServer struct {
 	config *HTTPConfig
 
-	auth CredentialValidator
-	dial func(network, address string) (net.Conn, error)
+	auth credentialChecker
+	dial func(user, network, address string) (net.Conn, error)
+	// tls makes the server accept TLS connections when set
+	tls *tls.Config
+	// pac returns the proxy auto-config file served to the requests that are not proxied, nil when there is none
+	pac func(requestHost string) []byte
 
 	logger       *device.Logger
 	authRequired bool
+	digest       digestAuth
+	lockout      *authLockout
 }
 
-func (s *HTTPServer) authenticate(req *http.Request) (int, error) {
+// authenticate checks the credentials of req, sent by client, returning the name of the authenticated user
+func (s *HTTPServer) authenticate(req *http.Request, client netip.Addr) (string, int, error) {
 	if !s.authRequired {
-		return 0, nil
+		return "", 0, nil
 	}
+	if s.lockout.locked(client) {
+		return "", http.StatusTooManyRequests, errTooManyFailures
+	}
+
+	user, err := s.checkAuthorization(req)
+	if err != nil {
+		// Clients first try without credentials, and retry when their nonce expired
+		if !errors.Is(err, errNoCredentials) && !errors.Is(err, errStaleNonce) && s.lockout.fail(client) {
+			s.logger.Errorf("HTTP locking out %s after %d failed authentications", client, authMaxFailures)
+		}
+		return "", http.StatusProxyAuthRequired, err
+	}
+	s.lockout.succeed(client)
+	return user, 0, nil
+}
 
+// checkAuthorization checks the Basic or Digest credentials of req
+func (s *HTTPServer) checkAuthorization(req *http.Request) (string, error) {
 	auth := req.Header.Get(proxyAuthHeaderKey)
 	if auth == "" {
-		return http.StatusProxyAuthRequired, fmt.Errorf("%s", http.StatusText(http.StatusProxyAuthRequired))
+		return "", errNoCredentials
 	}
 
-	enc := strings.TrimPrefix(auth, "Basic ")
-	str, err := base64.StdEncoding.DecodeString(enc)
-	if err != nil {
-		return http.StatusNotAcceptable, fmt.Errorf("decode username and password failed: %w", err)
-	}
-	pairs := bytes.SplitN(str, []byte(":"), 2)
-	if len(pairs) != 2 {
-		return http.StatusLengthRequired, fmt.Errorf("username and password format invalid")
+	scheme, credentials, _ := strings.Cut(auth, " ")
+	switch {
+	case strings.EqualFold(scheme, "Basic"):
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+		if err != nil {
+			return "", fmt.Errorf("decode username and password failed: %w", err)
+		}
+		username, password, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return "", errors.New("username and password format invalid")
+		}
+		if !s.auth.Valid(username, password) {
+			return "", errNotMatching
+		}
+		return username, nil
+	case strings.EqualFold(scheme, "Digest"):
+		secrets, ok := s.auth.(digestSecrets)
+		if !ok || !secrets.digestAvailable() {
+			return "", errors.New("Digest authentication is not available")
+		}
+		return s.digest.verify(parseAuthParams(credentials), req.Method, req.RequestURI, secrets)
+	default:
+		return "", errors.New("unsupported authentication scheme: " + scheme)
 	}
-	if s.auth.Valid(string(pairs[0]), string(pairs[1])) {
-		return 0, nil
+}
+
+// challenge adds the Proxy-Authenticate headers to resp, after a failed authentication
+func (s *HTTPServer) challenge(resp *http.Response, err error) {
+	secrets, ok := s.auth.(digestSecrets)
+	digest := ok && secrets.digestAvailable()
+	for _, challenge := range s.digest.challenges(digest, errors.Is(err, errStaleNonce)) {
+		resp.Header.Add("Proxy-Authenticate", challenge)
 	}
-	return http.StatusUnauthorized, fmt.Errorf("username and password not matching")
 }
 
-func (s *HTTPServer) handleConn(req *http.Request, conn net.Conn) (peer net.Conn, err error) {
+func (s *HTTPServer) handleConn(req *http.Request, conn net.Conn, user string) (peer net.Conn, err error) {
 	addr := req.Host
 	if !strings.Contains(addr, ":") {
 		port := "443"
 		addr = net.JoinHostPort(addr, port)
 	}
 
-	peer, err = s.dial("tcp", addr)
+	peer, err = s.dial(user, "tcp", addr)
 	if err != nil {
 		return peer, fmt.Errorf("tun tcp dial failed: %w", err)
 	}
@@ -74,14 +120,14 @@ func (s *HTTPServer) handleConn(req *http.Request, conn net.Conn) (peer net.Conn
 	return
 }
 
-func (s *HTTPServer) handle(req *http.Request) (peer net.Conn, err error) {
+func (s *HTTPServer) handle(req *http.Request, user string) (peer net.Conn, err error) {
 	addr := req.Host
 	if !strings.Contains(addr, ":") {
 		port := "80"
 		addr = net.JoinHostPort(addr, port)
 	}
 
-	peer, err = s.dial("tcp", addr)
+	peer, err = s.dial(user, "tcp", addr)
 	if err != nil {
 		return peer, fmt.Errorf("tun tcp dial failed: %w", err)
 	}
@@ -97,6 +143,12 @@ func (s *HTTPServer) handle(req *http.Request) (peer net.Conn, err error) {
 }
 
 func (s *HTTPServer) serve(conn net.Conn) {
+	certUser, err := certificateUser(conn)
+	if err != nil {
+		s.logger.Errorf("HTTP TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+
 	var rd = bufio.NewReader(conn)
 	req, err := http.ReadRequest(rd)
 	if err != nil {
@@ -106,29 +158,52 @@ func (s *HTTPServer) serve(conn net.Conn) {
 		return
 	}
 
-	code, err := s.authenticate(req)
-	if err != nil {
-		resp := responseWith(req, code)
-		if code == http.StatusProxyAuthRequired {
-			resp.Header.Set("Proxy-Authenticate", "Basic realm=\"Proxy\"")
-		}
+	// Browsers fetch the auto-config file before they know how to authenticate
+	if s.pac != nil && isPACRequest(req) {
+		pac := s.pac(req.Host)
+		resp := responseWith(req, http.StatusOK)
+		resp.Header.Set("Content-Type", pacContentType)
+		resp.Body = io.NopCloser(bytes.NewReader(pac))
+		resp.ContentLength = int64(len(pac))
 		_ = resp.Write(conn)
-		s.logger.Errorf("HTTP authentication failed: %v", err)
 		return
 	}
 
+	// A verified client certificate stands for the credentials
+	user := certUser
+	if user == "" {
+		var code int
+		user, code, err = s.authenticate(req, remoteAddr(conn))
+		if err != nil {
+			resp := responseWith(req, code)
+			if code == http.StatusProxyAuthRequired {
+				s.challenge(resp, err)
+			}
+			_ = resp.Write(conn)
+			s.logger.Errorf("HTTP authentication of %s failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+	req.Header.Del(proxyAuthHeaderKey)
+
 	var peer net.Conn
 	switch req.Method {
 	case http.MethodConnect:
-		peer, err = s.handleConn(req, conn)
+		peer, err = s.handleConn(req, conn, user)
 	case http.MethodGet:
-		peer, err = s.handle(req)
+		peer, err = s.handle(req, user)
 	default:
 		_ = responseWith(req, http.StatusMethodNotAllowed).Write(conn)
 		s.logger.Errorf("HTTP unsupported protocol: %s", req.Method)
 		return
 	}
 	if err != nil {
+		switch {
+		case errors.Is(err, errRejected), errors.Is(err, errDestinationDenied), errors.Is(err, errQuotaExceeded):
+			_ = responseWith(req, http.StatusForbidden).Write(conn)
+		case errors.Is(err, errTooManyConnections):
+			_ = responseWith(req, http.StatusTooManyRequests).Write(conn)
+		}
 		if !strings.Contains(err.Error(), "connection reset by peer") && err != io.EOF {
 			s.logger.Errorf("HTTP handle failed: %v", err)
 		}
@@ -170,6 +245,10 @@ func (s *HTTPServer) ListenAndServe(ctx context.Context, network, addr string) e
 		s.logger.Errorf("HTTP net.Listen failed: %v", err)
 		return err
 	}
+	listener = listenAllowed(listener, s.config.AllowFrom, s.logger)
+	if s.tls != nil {
+		listener = tls.NewListener(listener, s.tls)
+	}
 	s.logger.Verbosef("HTTP listener bound successfully on %s", addr)
 
 	errCh := make(chan error, 1)
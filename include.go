@@ -0,0 +1,120 @@
+package wireproxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+// includedConfig is a configuration file loaded by an Include directive
+type includedConfig struct {
+	path string
+	cfg  *ini.File
+}
+
+// loadIncludes loads the files matched by the Include patterns of cfg, read from path, and
+// the files they include in turn. stack lists the files being included, to detect loops,
+// and files included more than once are only loaded the first time.
+func loadIncludes(cfg *ini.File, path string, stack []string, seen map[string]bool) ([]includedConfig, error) {
+	key, err := cfg.Section("").GetKey("Include")
+	if err != nil {
+		return nil, nil
+	}
+
+	dir := "."
+	if path != "" {
+		dir = filepath.Dir(path)
+		if abs, err := filepath.Abs(path); err == nil {
+			stack = append(stack, abs)
+		}
+	}
+
+	var includes []includedConfig
+	for _, pattern := range key.ValueWithShadows() {
+		pattern = os.ExpandEnv(strings.TrimSpace(pattern))
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Include %s: %w", pattern, err)
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			// A missing file is an error, unlike a pattern matching nothing
+			return nil, fmt.Errorf("Include %s: %w", pattern, os.ErrNotExist)
+		}
+
+		for _, match := range matches {
+			abs, err := filepath.Abs(match)
+			if err != nil {
+				return nil, err
+			}
+			for i, included := range stack {
+				if included == abs {
+					return nil, errors.New("include loop: " + strings.Join(append(stack[i:], abs), " -> "))
+				}
+			}
+			if seen[abs] {
+				continue
+			}
+			seen[abs] = true
+
+			include, err := loadInclude(match)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", match, err)
+			}
+			includes = append(includes, include)
+
+			nested, err := loadIncludes(include.cfg, match, stack, seen)
+			if err != nil {
+				return nil, err
+			}
+			includes = append(includes, nested...)
+		}
+	}
+
+	return includes, nil
+}
+
+// includedSections are the sections an included file may contribute, those parsed by parseProxySections
+var includedSections = map[string]bool{
+	"socks5":         true,
+	"http":           true,
+	"mixed":          true,
+	"transparenttcp": true,
+	"sniproxy":       true,
+	"rule":           true,
+	"user":           true,
+}
+
+// loadInclude loads an included file, which may only hold routines, [Rule] and [User] sections and Include directives
+func loadInclude(path string) (includedConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return includedConfig{}, err
+	}
+
+	cfg, err := loadConfigStringAs(string(data), ConfigFormat(path))
+	if err != nil {
+		return includedConfig{}, err
+	}
+
+	for _, key := range cfg.Section("").Keys() {
+		if !strings.EqualFold(key.Name(), "Include") {
+			return includedConfig{}, errors.New(key.Name() + " cannot be set in an included file")
+		}
+	}
+	for _, section := range cfg.Sections() {
+		if section == cfg.Section("") || includedSections[strings.ToLower(section.Name())] {
+			continue
+		}
+		return includedConfig{}, errors.New("[" + section.Name() + "] cannot be set in an included file")
+	}
+
+	return includedConfig{path: path, cfg: cfg}, nil
+}
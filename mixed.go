@@ -0,0 +1,260 @@
+package wireproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+// SOCKS4 protocol constants
+const (
+	socks4Version        = 0x04
+	socks5Version        = 0x05
+	socks4CommandConnect = 0x01
+	socks4Granted        = 0x5a
+	socks4Rejected       = 0x5b
+	// socks4MaxField bounds the length of the user ID and domain name of a request
+	socks4MaxField = 255
+)
+
+// peekedConn is a connection whose first bytes were read ahead to pick a protocol or a
+// destination, reader returning them before the rest of the connection
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// socks4Server serves SOCKS4 and SOCKS4a clients
+type socks4Server struct {
+	auth    credentialChecker
+	dial    func(user, network, address string) (net.Conn, error)
+	logger  *device.Logger
+	lockout *authLockout
+}
+
+// socks4Request is a SOCKS4 or SOCKS4a CONNECT request
+type socks4Request struct {
+	command byte
+	port    uint16
+	ip      net.IP
+	userID  string
+	// domain is the host name of a SOCKS4a request, empty for a SOCKS4 one
+	domain string
+}
+
+// address returns the destination of the request as host:port
+func (r *socks4Request) address() string {
+	host := r.domain
+	if host == "" {
+		host = r.ip.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(r.port)))
+}
+
+// readSocks4Request reads a request, the version byte included
+func readSocks4Request(reader *bufio.Reader) (*socks4Request, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != socks4Version {
+		return nil, errors.New("unsupported SOCKS version " + strconv.Itoa(int(header[0])))
+	}
+
+	req := &socks4Request{
+		command: header[1],
+		port:    binary.BigEndian.Uint16(header[2:4]),
+		ip:      net.IP(header[4:8]),
+	}
+
+	var err error
+	req.userID, err = readSocks4String(reader)
+	if err != nil {
+		return nil, err
+	}
+	// SOCKS4a marks a domain name following the user ID with the address 0.0.0.x, x being non zero
+	if header[4] == 0 && header[5] == 0 && header[6] == 0 && header[7] != 0 {
+		req.domain, err = readSocks4String(reader)
+		if err != nil {
+			return nil, err
+		}
+		if req.domain == "" {
+			return nil, errors.New("empty SOCKS4a domain name")
+		}
+	}
+	return req, nil
+}
+
+// readSocks4String reads a NUL terminated field of a request
+func readSocks4String(reader *bufio.Reader) (string, error) {
+	var field strings.Builder
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return field.String(), nil
+		}
+		if field.Len() == socks4MaxField {
+			return "", errors.New("SOCKS4 field too long")
+		}
+		field.WriteByte(b)
+	}
+}
+
+// writeSocks4Reply answers a request with status
+func writeSocks4Reply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{0, status, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// authenticate checks the user ID of a request sent by client, which holds user:password
+// when the proxy requires authentication, returning the authenticated user
+func (s *socks4Server) authenticate(req *socks4Request, client netip.Addr) (string, error) {
+	if s.auth == nil {
+		return "", nil
+	}
+	username, password, ok := strings.Cut(req.userID, ":")
+	if !ok {
+		s.lockout.fail(client)
+		return "", errNotMatching
+	}
+	if err := s.lockout.validate(s.auth, client, username, password); err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+// serve handles a SOCKS4 connection, whose request is read from reader
+func (s *socks4Server) serve(conn net.Conn, reader *bufio.Reader) {
+	req, err := readSocks4Request(reader)
+	if err != nil {
+		if err != io.EOF {
+			s.logger.Errorf("SOCKS4 read request from %s failed: %v", conn.RemoteAddr(), err)
+		}
+		return
+	}
+
+	if req.command != socks4CommandConnect {
+		_ = writeSocks4Reply(conn, socks4Rejected)
+		s.logger.Errorf("SOCKS4 unsupported command %d from %s", req.command, conn.RemoteAddr())
+		return
+	}
+
+	user, err := s.authenticate(req, remoteAddr(conn))
+	if err != nil {
+		_ = writeSocks4Reply(conn, socks4Rejected)
+		s.logger.Errorf("SOCKS4 authentication of %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	peer, err := s.dial(user, "tcp", req.address())
+	if err != nil {
+		_ = writeSocks4Reply(conn, socks4Rejected)
+		s.logger.Errorf("SOCKS4 connect to %s failed: %v", req.address(), err)
+		return
+	}
+	defer peer.Close()
+
+	if err := writeSocks4Reply(conn, socks4Granted); err != nil {
+		return
+	}
+
+	relay(&peekedConn{Conn: conn, reader: reader}, peer)
+}
+
+// SpawnRoutine spawns a proxy serving SOCKS4/4a, SOCKS5 and HTTP clients, told apart by
+// the first byte they send.
+func (config *MixedConfig) SpawnRoutine(ctx context.Context, vt *VirtualTun) error {
+	tunnels, err := vt.newBalancer(config.TunnelSelection)
+	if err != nil {
+		return err
+	}
+	logger := vt.Logger
+	logger.Verbosef("Mixed SpawnRoutine started for bindAddress %s", config.BindAddress)
+
+	credentials, err := newProxyCredentials(ctx, config.Username, config.Password, config.UsersFile, logger)
+	if err != nil {
+		return err
+	}
+	if credentials != nil {
+		logger.Verbosef("Mixed using authentication with username %s and users file %s", config.Username, config.UsersFile)
+	} else {
+		logger.Verbosef("Mixed using no authentication")
+	}
+
+	dial := func(user, network, address string) (net.Conn, error) {
+		return vt.dialUser(ctx, tunnels, user, network, address)
+	}
+	// A client failing to authenticate is locked out of every protocol
+	lockout := &authLockout{}
+	socks5Server := newSocks5Server(vt, tunnels, credentials, lockout)
+	socks4Server := &socks4Server{auth: credentials, dial: dial, logger: logger, lockout: lockout}
+	httpServer := &HTTPServer{
+		config:       &HTTPConfig{},
+		auth:         credentials,
+		dial:         dial,
+		logger:       logger,
+		authRequired: credentials != nil,
+		lockout:      lockout,
+	}
+	if vt.PAC != nil {
+		httpServer.pac = vt.pacFile
+	}
+
+	listener, err := net.Listen("tcp", config.BindAddress)
+	if err != nil {
+		logger.Errorf("Mixed net.Listen failed: %v", err)
+		return err
+	}
+	listener = listenAllowed(listener, config.AllowFrom, logger)
+	logger.Verbosef("Mixed listener bound successfully on %s", config.BindAddress)
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				logger.Verbosef("Mixed accept loop exited gracefully on listener close")
+				return nil
+			}
+			logger.Errorf("Mixed accept error: %v", err)
+			return err
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+
+			reader := bufio.NewReader(conn)
+			first, err := reader.Peek(1)
+			if err != nil {
+				return
+			}
+			peeked := &peekedConn{Conn: conn, reader: reader}
+			switch first[0] {
+			case socks4Version:
+				socks4Server.serve(conn, reader)
+			case socks5Version:
+				serveSocks5Conn(socks5Server, peeked, logger)
+			default:
+				httpServer.serve(peeked)
+			}
+		}(conn)
+	}
+}
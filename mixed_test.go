@@ -0,0 +1,107 @@
+package wireproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+func TestSocks4Proxy(t *testing.T) {
+	credentials, err := newProxyCredentials(context.Background(), "peter", "secret", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		request []byte
+		address string
+		user    string
+		status  byte
+	}{
+		{"SOCKS4", append([]byte{4, 1, 0, 80, 10, 0, 0, 1}, "peter:secret\x00"...), "10.0.0.1:80", "peter", socks4Granted},
+		{"SOCKS4a", append([]byte{4, 1, 1, 187, 0, 0, 0, 1}, "peter:secret\x00example.com\x00"...), "example.com:443", "peter", socks4Granted},
+		{"wrong password", append([]byte{4, 1, 0, 80, 10, 0, 0, 1}, "peter:wrong\x00"...), "", "", socks4Rejected},
+		{"BIND", append([]byte{4, 2, 0, 80, 10, 0, 0, 1}, "peter:secret\x00"...), "", "", socks4Rejected},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var address, user string
+			server := &socks4Server{
+				auth: credentials,
+				dial: func(u, _, a string) (net.Conn, error) {
+					address, user = a, u
+					return pipeUpstream(closeUpstream), nil
+				},
+				logger:  device.NewLogger(device.LogLevelSilent, ""),
+				lockout: &authLockout{},
+			}
+
+			clientConn, done := startTestProxy(t, func(conn net.Conn) {
+				server.serve(conn, bufio.NewReader(conn))
+			})
+
+			if _, err := clientConn.Write(test.request); err != nil {
+				t.Fatal(err)
+			}
+			reply := make([]byte, 8)
+			if _, err := io.ReadFull(clientConn, reply); err != nil {
+				t.Fatal(err)
+			}
+			_ = clientConn.Close()
+			<-done
+
+			if reply[1] != test.status || address != test.address || user != test.user {
+				t.Errorf("unexpected result: status %#x, address %q, user %q", reply[1], address, user)
+			}
+		})
+	}
+}
+
+func TestMixedAuthLockout(t *testing.T) {
+	credentials, err := newProxyCredentials(context.Background(), "peter", "secret", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockout := &authLockout{}
+	client := netip.MustParseAddr("192.0.2.1")
+
+	// Failures over SOCKS4 and SOCKS5 add up, and lock the client out of HTTP too
+	socks4 := &socks4Server{auth: credentials, lockout: lockout}
+	socks5 := socksCredentials{credentials, lockout}
+	for i := 0; i < authMaxFailures; i++ {
+		if i%2 == 0 {
+			if _, err := socks4.authenticate(&socks4Request{userID: "peter:wrong"}, client); err == nil {
+				t.Fatal("SOCKS4 authentication accepted with a wrong password")
+			}
+		} else if socks5.Valid("peter", "wrong", "192.0.2.1:40000") {
+			t.Fatal("SOCKS5 authentication accepted with a wrong password")
+		}
+	}
+	if socks5.Valid("peter", "secret", "192.0.2.1:40001") {
+		t.Error("SOCKS5 client not locked out")
+	}
+
+	server := &HTTPServer{
+		auth:         credentials,
+		logger:       device.NewLogger(device.LogLevelSilent, ""),
+		authRequired: true,
+		lockout:      lockout,
+	}
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(
+		"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nProxy-Authorization: Basic " +
+			base64.StdEncoding.EncodeToString([]byte("peter:secret")) + "\r\n\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, code, _ := server.authenticate(req, client); code != http.StatusTooManyRequests {
+		t.Errorf("HTTP client not locked out: %d", code)
+	}
+}
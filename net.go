@@ -3,8 +3,12 @@
 package wireproxy
 
 import (
+	"io"
 	"net"
 	"net/netip"
+	"sync"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
 )
 
 func TCPAddrFromAddrPort(addr netip.AddrPort) *net.TCPAddr {
@@ -14,3 +18,74 @@ func TCPAddrFromAddrPort(addr netip.AddrPort) *net.TCPAddr {
 		Port: int(addr.Port()),
 	}
 }
+
+// allowListener closes the accepted connections whose source address is not in allowFrom
+type allowListener struct {
+	net.Listener
+	allowFrom []netip.Prefix
+	logger    *device.Logger
+}
+
+// listenAllowed wraps listener so that it only accepts connections from allowFrom,
+// listener being returned as is when allowFrom is empty
+func listenAllowed(listener net.Listener, allowFrom []netip.Prefix, logger *device.Logger) net.Listener {
+	if len(allowFrom) == 0 {
+		return listener
+	}
+	return &allowListener{Listener: listener, allowFrom: allowFrom, logger: logger}
+}
+
+func (l *allowListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.allowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		l.logger.Errorf("Rejected connection from %s to %s: not in AllowFrom", conn.RemoteAddr(), l.Addr())
+		_ = conn.Close()
+	}
+}
+
+// remoteAddr returns the address of the remote end of conn, invalid when it is not a TCP connection
+func remoteAddr(conn net.Conn) netip.Addr {
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return netip.Addr{}
+	}
+	return tcpAddr.AddrPort().Addr().Unmap()
+}
+
+func (l *allowListener) allowed(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip := tcpAddr.AddrPort().Addr().Unmap()
+	for _, prefix := range l.allowFrom {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// relay copies data between conn and peer until both directions are done, closing each
+// connection once the other end has nothing more to send
+func relay(conn, peer net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(conn, peer)
+		_ = conn.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(peer, conn)
+		_ = peer.Close()
+	}()
+	wg.Wait()
+}
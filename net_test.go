@@ -0,0 +1,87 @@
+package wireproxy
+
+import (
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+func TestProxyAllowFrom(t *testing.T) {
+	config := `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+
+[Socks5]
+BindAddress = 127.0.0.1:25344
+AllowFrom = 127.0.0.1/8, 192.168.1.0/24, ::1`
+	conf, err := ParseConfigString(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowFrom := conf.Routines[0].(*Socks5Config).AllowFrom
+	expected := []netip.Prefix{
+		netip.MustParsePrefix("127.0.0.0/8"),
+		netip.MustParsePrefix("192.168.1.0/24"),
+		netip.MustParsePrefix("::1/128"),
+	}
+	if !reflect.DeepEqual(allowFrom, expected) {
+		t.Fatalf("unexpected AllowFrom: %v", allowFrom)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := listenAllowed(listener, allowFrom, device.NewLogger(device.LogLevelSilent, "")).(*allowListener)
+	defer allowed.Close()
+	for addr, valid := range map[string]bool{
+		"127.0.0.1:1080":        true,
+		"192.168.1.20:1080":     true,
+		"[::ffff:127.0.0.2]:80": true,
+		"[::1]:1080":            true,
+		"192.168.2.20:1080":     false,
+		"[::2]:1080":            false,
+	} {
+		if allowed.allowed(net.TCPAddrFromAddrPort(netip.MustParseAddrPort(addr))) != valid {
+			t.Errorf("unexpected result for %s", addr)
+		}
+	}
+
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+	conn, err := allowed.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	denied := listenAllowed(listener, expected[1:], device.NewLogger(device.LogLevelSilent, ""))
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err == nil {
+			_, _ = conn.Read(make([]byte, 1))
+			_ = conn.Close()
+		}
+		_ = listener.Close()
+	}()
+	if conn, err := denied.Accept(); err == nil {
+		_ = conn.Close()
+		t.Error("connection from outside AllowFrom accepted")
+	}
+
+	if _, err := ParseConfigString(config + ", nowhere"); err == nil {
+		t.Error("invalid AllowFrom accepted")
+	}
+}
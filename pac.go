@@ -0,0 +1,115 @@
+package wireproxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+const (
+	// pacPath is where the proxy auto-config file is served
+	pacPath = "/proxy.pac"
+	// pacContentType is the media type browsers expect for a proxy auto-config file
+	pacContentType = "application/x-ns-proxy-autoconfig"
+)
+
+// pacDirectives returns the PAC directives reaching the proxy bound to bindAddress with the
+// given schemes. host replaces the host of bindAddress when set, requestHost being used
+// for the unspecified addresses.
+func pacDirectives(bindAddress, host, requestHost string, schemes ...string) []string {
+	bindHost, port, err := net.SplitHostPort(bindAddress)
+	if err != nil {
+		return nil
+	}
+	if host == "" {
+		host = bindHost
+		if addr, err := netip.ParseAddr(bindHost); bindHost == "" || (err == nil && addr.IsUnspecified()) {
+			host = requestHost
+		}
+	}
+	if host == "" {
+		return nil
+	}
+
+	var directives []string
+	for _, scheme := range schemes {
+		directives = append(directives, scheme+" "+net.JoinHostPort(host, port))
+	}
+	return directives
+}
+
+// Generate returns the proxy auto-config file sending the destinations of c through routines.
+// requestHost is the host the file was requested from, used when neither Host nor the
+// BindAddress of a proxy tell where browsers can reach it.
+func (c *PACConfig) Generate(routines []RoutineSpawner, requestHost string) []byte {
+	if host, _, err := net.SplitHostPort(requestHost); err == nil {
+		requestHost = host
+	}
+
+	var directives []string
+	for _, routine := range routines {
+		switch routine := routine.(type) {
+		case *Socks5Config:
+			directives = append(directives, pacDirectives(routine.BindAddress, c.Host, requestHost, "SOCKS5", "SOCKS")...)
+		case *HTTPConfig:
+			scheme := "PROXY"
+			if routine.CertFile != "" {
+				scheme = "HTTPS"
+			}
+			directives = append(directives, pacDirectives(routine.BindAddress, c.Host, requestHost, scheme)...)
+		case *MixedConfig:
+			directives = append(directives, pacDirectives(routine.BindAddress, c.Host, requestHost, "SOCKS5", "PROXY")...)
+		}
+	}
+	// Without any proxy the browsers would get nowhere, there is nothing better than DIRECT
+	if len(directives) == 0 {
+		directives = []string{"DIRECT"}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("function FindProxyForURL(url, host) {\n")
+	fmt.Fprintf(&buf, "\tvar proxy = %s;\n", strconv.Quote(strings.Join(directives, "; ")))
+	if len(c.Domains) == 0 && len(c.Prefixes) == 0 {
+		buf.WriteString("\treturn proxy;\n}\n")
+		return buf.Bytes()
+	}
+
+	buf.WriteString("\thost = host.toLowerCase();\n")
+	for _, domain := range c.Domains {
+		fmt.Fprintf(&buf, "\tif (host == %s || dnsDomainIs(host, %s)) return proxy;\n", strconv.Quote(domain), strconv.Quote("."+domain))
+	}
+
+	// isInNet resolves names with the DNS of the host, so it is only applied to addresses.
+	// Browsers do not support IPv6 in isInNet, IPv6 prefixes are left out.
+	var ipv4 []netip.Prefix
+	for _, prefix := range c.Prefixes {
+		if prefix.Addr().Is4() {
+			ipv4 = append(ipv4, prefix)
+		}
+	}
+	if len(ipv4) > 0 {
+		buf.WriteString("\tif (/^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host)) {\n")
+		for _, prefix := range ipv4 {
+			mask := net.CIDRMask(prefix.Bits(), 32)
+			fmt.Fprintf(&buf, "\t\tif (isInNet(host, %q, %q)) return proxy;\n", prefix.Addr(), net.IP(mask).String())
+		}
+		buf.WriteString("\t}\n")
+	}
+	buf.WriteString("\treturn \"DIRECT\";\n}\n")
+	return buf.Bytes()
+}
+
+// pacFile returns the proxy auto-config file of the routines of d, requested from requestHost
+func (d *VirtualTun) pacFile(requestHost string) []byte {
+	return d.PAC.Generate(d.Routines, requestHost)
+}
+
+// isPACRequest reports whether req asks a proxy for its auto-config file, rather than
+// asking it to forward a request
+func isPACRequest(req *http.Request) bool {
+	return req.Method == http.MethodGet && req.URL.Host == "" && req.URL.Path == pacPath
+}
@@ -0,0 +1,85 @@
+package wireproxy
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+func TestPACFile(t *testing.T) {
+	config := `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+
+[Socks5]
+BindAddress = 127.0.0.1:25344
+
+[http]
+BindAddress = 0.0.0.0:25345
+
+[Mixed]
+BindAddress = :25346
+
+[PAC]
+Domain = Example.com, 10.0.0.0/8, fd00::/8`
+	conf, err := ParseConfigString(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `function FindProxyForURL(url, host) {
+	var proxy = "SOCKS5 127.0.0.1:25344; SOCKS 127.0.0.1:25344; PROXY proxy.lan:25345; SOCKS5 proxy.lan:25346; PROXY proxy.lan:25346";
+	host = host.toLowerCase();
+	if (host == "example.com" || dnsDomainIs(host, ".example.com")) return proxy;
+	if (/^\d+\.\d+\.\d+\.\d+$/.test(host)) {
+		if (isInNet(host, "10.0.0.0", "255.0.0.0")) return proxy;
+	}
+	return "DIRECT";
+}
+`
+	if pac := string(conf.PAC.Generate(conf.Routines, "proxy.lan:9080")); pac != expected {
+		t.Errorf("unexpected PAC file:\n%s", pac)
+	}
+
+	conf.PAC = &PACConfig{Host: "10.1.1.1"}
+	expected = `function FindProxyForURL(url, host) {
+	var proxy = "SOCKS5 10.1.1.1:25344; SOCKS 10.1.1.1:25344; PROXY 10.1.1.1:25345; SOCKS5 10.1.1.1:25346; PROXY 10.1.1.1:25346";
+	return proxy;
+}
+`
+	if pac := string(conf.PAC.Generate(conf.Routines, "")); pac != expected {
+		t.Errorf("unexpected PAC file:\n%s", pac)
+	}
+
+	server := &HTTPServer{
+		auth:         CredentialValidator{"peter", "secret"},
+		logger:       device.NewLogger(device.LogLevelSilent, ""),
+		authRequired: true,
+		lockout:      &authLockout{},
+		pac: func(host string) []byte {
+			return conf.PAC.Generate(conf.Routines, host)
+		},
+	}
+	clientConn, _ := startTestProxy(t, server.serve)
+	if _, err := clientConn.Write([]byte("GET /proxy.pac HTTP/1.1\r\nHost: proxy.lan:25345\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(clientConn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != pacContentType || string(body) != expected {
+		t.Errorf("unexpected response: %d %s\n%s", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+}
@@ -0,0 +1,261 @@
+package wireproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errDestinationDenied  = errors.New("destination not allowed for the user")
+	errTooManyConnections = errors.New("too many connections for the user")
+	errQuotaExceeded      = errors.New("monthly quota of the user exceeded")
+)
+
+// UserPolicy restricts the connections of an authenticated proxy user
+type UserPolicy struct {
+	Name string
+	// Destinations holds the conditions the destinations of the user must match,
+	// every destination being allowed without conditions
+	Destinations RouteRule
+	// MaxConnections bounds the concurrent connections of the user, 0 meaning no limit
+	MaxConnections int
+	// Bandwidth bounds the bytes per second the user sends, and those it receives, 0 meaning no limit
+	Bandwidth int64
+	// MonthlyQuota bounds the bytes the user transfers in a calendar month, 0 meaning no limit.
+	// The usage is kept in memory and starts again from 0 when wireproxy restarts.
+	MonthlyQuota int64
+
+	connections atomic.Int64
+	rejected    atomic.Uint64
+	sent        atomic.Uint64
+	received    atomic.Uint64
+
+	lock       sync.Mutex
+	month      int
+	monthBytes int64
+	upload     *rateLimiter
+	download   *rateLimiter
+	limitOnce  sync.Once
+}
+
+// userContextKey holds the name of the authenticated user in the context of a SOCKS5 request
+type userContextKey struct{}
+
+// withUser returns ctx holding the name of the authenticated user
+func withUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userContextKey{}, user)
+}
+
+// userFrom returns the name of the user authenticated for ctx, empty when there is none
+func userFrom(ctx context.Context) string {
+	user, _ := ctx.Value(userContextKey{}).(string)
+	return user
+}
+
+// currentMonth numbers the calendar months in UTC
+func currentMonth() int {
+	now := time.Now().UTC()
+	return now.Year()*12 + int(now.Month())
+}
+
+// allows checks that the user may connect to host:port, without counting the connection
+func (p *UserPolicy) allows(host string, port uint16) error {
+	if !p.Destinations.Match(host, port) {
+		return errDestinationDenied
+	}
+	if p.quotaExceeded() {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// admit checks that the user may open a connection to host:port, counting the connection until release
+func (p *UserPolicy) admit(host string, port uint16) error {
+	if err := p.allows(host, port); err != nil {
+		p.rejected.Add(1)
+		return err
+	}
+	if connections := p.connections.Add(1); p.MaxConnections > 0 && connections > int64(p.MaxConnections) {
+		p.connections.Add(-1)
+		p.rejected.Add(1)
+		return errTooManyConnections
+	}
+	return nil
+}
+
+func (p *UserPolicy) release() {
+	p.connections.Add(-1)
+}
+
+// quotaExceeded reports whether the user transferred its MonthlyQuota this month
+func (p *UserPolicy) quotaExceeded() bool {
+	if p.MonthlyQuota == 0 {
+		return false
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if month := currentMonth(); month != p.month {
+		p.month = month
+		p.monthBytes = 0
+	}
+	return p.monthBytes >= p.MonthlyQuota
+}
+
+// account adds n bytes to the usage of the month
+func (p *UserPolicy) account(n int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if month := currentMonth(); month != p.month {
+		p.month = month
+		p.monthBytes = 0
+	}
+	p.monthBytes += int64(n)
+}
+
+// monthUsage returns the bytes transferred by the user this month
+func (p *UserPolicy) monthUsage() int64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.month != currentMonth() {
+		return 0
+	}
+	return p.monthBytes
+}
+
+// limiters returns the rate limiters shared by the connections of the user, nil without Bandwidth
+func (p *UserPolicy) limiters() (upload, download *rateLimiter) {
+	p.limitOnce.Do(func() {
+		if p.Bandwidth > 0 {
+			p.upload = &rateLimiter{rate: p.Bandwidth}
+			p.download = &rateLimiter{rate: p.Bandwidth}
+		}
+	})
+	return p.upload, p.download
+}
+
+// wrap returns conn counting the traffic of the user and applying its Bandwidth and MonthlyQuota.
+// Closing the returned connection releases it.
+func (p *UserPolicy) wrap(conn net.Conn) net.Conn {
+	upload, download := p.limiters()
+	return &policyConn{Conn: conn, policy: p, upload: upload, download: download}
+}
+
+// writeMetrics writes the usage counters of the user to buf, in the format of /metrics
+func (p *UserPolicy) writeMetrics(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "user=%s\n", p.Name)
+	fmt.Fprintf(buf, "user_connections=%d\n", p.connections.Load())
+	fmt.Fprintf(buf, "user_rejected_connections=%d\n", p.rejected.Load())
+	fmt.Fprintf(buf, "user_tx_bytes=%d\n", p.sent.Load())
+	fmt.Fprintf(buf, "user_rx_bytes=%d\n", p.received.Load())
+	fmt.Fprintf(buf, "user_month_bytes=%d\n", p.monthUsage())
+}
+
+// policyConn is an upstream connection of a user with a UserPolicy
+type policyConn struct {
+	net.Conn
+	policy    *UserPolicy
+	upload    *rateLimiter
+	download  *rateLimiter
+	closeOnce sync.Once
+}
+
+func (c *policyConn) Read(b []byte) (int, error) {
+	if c.policy.quotaExceeded() {
+		return 0, errQuotaExceeded
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.policy.received.Add(uint64(n))
+		c.policy.account(n)
+		c.download.wait(n)
+	}
+	return n, err
+}
+
+func (c *policyConn) Write(b []byte) (int, error) {
+	if c.policy.quotaExceeded() {
+		return 0, errQuotaExceeded
+	}
+	c.upload.wait(len(b))
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.policy.sent.Add(uint64(n))
+		c.policy.account(n)
+	}
+	return n, err
+}
+
+func (c *policyConn) Close() error {
+	c.closeOnce.Do(c.policy.release)
+	return c.Conn.Close()
+}
+
+// rateLimiter spreads the bytes going through it so that they do not exceed rate bytes per second
+type rateLimiter struct {
+	rate int64
+
+	lock sync.Mutex
+	// next is when the bytes already let through are paid for
+	next time.Time
+}
+
+// wait blocks until n more bytes fit in the rate. A nil rateLimiter does not limit anything.
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	l.lock.Unlock()
+
+	time.Sleep(delay)
+}
+
+// userPolicy returns the policy of user, nil when the user is not restricted
+func (d *VirtualTun) userPolicy(user string) *UserPolicy {
+	if user == "" {
+		return nil
+	}
+	return d.Users[user]
+}
+
+// dialUser dials addr like dialRouted, for a connection of user
+func (d *VirtualTun) dialUser(ctx context.Context, tunnels *balancer, user, network, addr string) (net.Conn, error) {
+	policy := d.userPolicy(user)
+	if policy == nil {
+		return d.dialRouted(ctx, tunnels, network, addr)
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	if err := policy.admit(host, uint16(port)); err != nil {
+		return nil, err
+	}
+
+	conn, err := d.dialRouted(ctx, tunnels, network, addr)
+	if err != nil {
+		policy.release()
+		return nil, err
+	}
+	return policy.wrap(conn), nil
+}
@@ -0,0 +1,100 @@
+package wireproxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestUserPolicy(t *testing.T) {
+	config := `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+
+[Socks5]
+BindAddress = 127.0.0.1:25344
+Username = alice
+Password = secret
+
+[User]
+Name = alice
+Domain = example.com, 10.0.0.0/8
+Port = 80, 443
+MaxConnections = 1
+Bandwidth = 1M
+MonthlyQuota = 10`
+	conf, err := ParseConfigString(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy := conf.Users["alice"]
+	if policy == nil {
+		t.Fatal("missing policy of alice")
+	}
+	if policy.MaxConnections != 1 || policy.Bandwidth != 1<<20 || policy.MonthlyQuota != 10 {
+		t.Errorf("unexpected limits: %d %d %d", policy.MaxConnections, policy.Bandwidth, policy.MonthlyQuota)
+	}
+
+	if err := policy.allows("www.example.com", 443); err != nil {
+		t.Error(err)
+	}
+	if err := policy.allows("10.1.2.3", 80); err != nil {
+		t.Error(err)
+	}
+	if err := policy.allows("example.org", 443); err != errDestinationDenied {
+		t.Errorf("unexpected error for a denied domain: %v", err)
+	}
+	if err := policy.allows("example.com", 22); err != errDestinationDenied {
+		t.Errorf("unexpected error for a denied port: %v", err)
+	}
+
+	if err := policy.admit("example.com", 443); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.admit("example.com", 443); err != errTooManyConnections {
+		t.Errorf("unexpected error over MaxConnections: %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := policy.wrap(client)
+	go func() {
+		buf := make([]byte, 64)
+		_, _ = server.Read(buf)
+		_, _ = server.Write([]byte("0123456789"))
+	}()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(buf); err != errQuotaExceeded {
+		t.Errorf("unexpected error over MonthlyQuota: %v", err)
+	}
+	if err := policy.admit("example.com", 443); err != errQuotaExceeded {
+		t.Errorf("unexpected error for a new connection over MonthlyQuota: %v", err)
+	}
+	_ = conn.Close()
+	_ = conn.Close()
+
+	var metrics bytes.Buffer
+	policy.writeMetrics(&metrics)
+	expected := "user=alice\nuser_connections=0\nuser_rejected_connections=2\nuser_tx_bytes=5\nuser_rx_bytes=10\nuser_month_bytes=15\n"
+	if metrics.String() != expected {
+		t.Errorf("unexpected metrics:\n%s", metrics.String())
+	}
+
+	if _, err := ParseConfigString(config + "\n\n[User]\nName = alice\n"); err == nil {
+		t.Error("duplicate [User] section accepted")
+	}
+	if _, err := ParseConfigString(config + "\n\n[User]\nName = bob\nBandwidth = fast\n"); err == nil {
+		t.Error("invalid Bandwidth accepted")
+	}
+}
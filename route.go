@@ -0,0 +1,180 @@
+package wireproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/things-go/go-socks5"
+)
+
+const (
+	// RouteTunnel sends the connection through the tunnel of the routine
+	RouteTunnel = "tunnel"
+	// RouteDirect sends the connection through the host network
+	RouteDirect = "direct"
+	// RouteReject refuses the connection
+	RouteReject = "reject"
+)
+
+var errRejected = errors.New("rejected by routing rule")
+
+// Match reports whether a connection to host:port satisfies every condition of the rule.
+// host may be a domain name or an IP address; a rule without conditions matches everything.
+func (r *RouteRule) Match(host string, port uint16) bool {
+	if len(r.Domains) > 0 || len(r.Prefixes) > 0 {
+		if !r.matchHost(host) {
+			return false
+		}
+	}
+
+	if len(r.Ports) > 0 {
+		matched := false
+		for _, ports := range r.Ports {
+			if port >= ports.Start && port <= ports.End {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *RouteRule) matchHost(host string) bool {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		for _, prefix := range r.Prefixes {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, domain := range r.Domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// route returns the action of the first rule matching host:port, RouteTunnel if none does
+func (d *VirtualTun) route(host string, port uint16) string {
+	for _, rule := range d.Rules {
+		if rule.Match(host, port) {
+			return rule.Action
+		}
+	}
+	return RouteTunnel
+}
+
+// dialRouted dials addr for a routine sending its connections through tunnels,
+// following the routing rules of d. addr may hold a domain name, which is resolved
+// through the selected tunnel.
+func (d *VirtualTun) dialRouted(ctx context.Context, tunnels *balancer, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	switch action := d.route(host, uint16(port)); action {
+	case RouteTunnel:
+		return tunnels.dial(ctx, network, addr)
+	case RouteDirect:
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, addr)
+	case RouteReject:
+		return nil, errRejected
+	default:
+		tunnel, err := d.Tunnel(action)
+		if err != nil {
+			return nil, err
+		}
+		return tunnel.dial(ctx, network, addr)
+	}
+}
+
+// dial connects to addr through the active tunnel, resolving domain names with TUNResolver
+func (d *VirtualTun) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &TUNResolver{vt: d}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// Domain name, resolve using TUNResolver
+		_, resolvedIP, err := r.Resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		addr = net.JoinHostPort(resolvedIP.String(), port)
+	} else {
+		// Prefer IPv4
+		if ip.To4() == nil {
+			// Try to resolve an IPv4 if available
+			_, ipv4Addr, err := r.Resolve(ctx, host)
+			if err == nil && ipv4Addr.To4() != nil {
+				addr = net.JoinHostPort(ipv4Addr.String(), port)
+			}
+		}
+	}
+	conn, err := d.Active().currentNet().DialContext(ctx, network, addr)
+	if err != nil {
+		d.Logger.Errorf("DialContext failed for %s %s: %v", network, addr, err)
+		return nil, err
+	}
+	if conn == nil {
+		err = errors.New("DialContext returned nil conn without error")
+		d.Logger.Errorf("Invalid dial for %s %s: %v", network, addr, err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// deferredResolver leaves domain names unresolved so that the dial function
+// can apply the routing rules to them and resolve them through the right tunnel
+type deferredResolver struct{}
+
+func (deferredResolver) Resolve(ctx context.Context, _ string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
+
+// routeRuleSet refuses the SOCKS5 requests rejected by the routing rules of vt or the
+// policy of the user, whose name it passes on in the context of the request
+type routeRuleSet struct {
+	vt *VirtualTun
+}
+
+func (r routeRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	host := req.DestAddr.FQDN
+	if host == "" {
+		host = req.DestAddr.IP.String()
+	}
+	port := uint16(req.DestAddr.Port)
+
+	if req.AuthContext != nil {
+		if user := req.AuthContext.Payload["username"]; user != "" {
+			ctx = withUser(ctx, user)
+			if policy := r.vt.userPolicy(user); policy != nil && policy.allows(host, port) != nil {
+				policy.rejected.Add(1)
+				return ctx, false
+			}
+		}
+	}
+	return ctx, r.vt.route(host, port) != RouteReject
+}
@@ -12,11 +12,13 @@ import (
 	"net"
 	"net/http"
 	"path"
+	"sort"
 	"strings"
 	"time"
 
 	srand "crypto/rand"
 
+	"github.com/amnezia-vpn/amneziawg-go/device"
 	"github.com/things-go/go-socks5"
 	"github.com/things-go/go-socks5/bufferpool"
 	"golang.org/x/net/icmp"
@@ -29,6 +31,11 @@ type RoutineSpawner interface {
 	SpawnRoutine(ctx context.Context, vt *VirtualTun) error
 }
 
+// tunnelSelector is implemented by routines that can be bound to named tunnels with `Device = <name>`
+type tunnelSelector interface {
+	tunnelNames() []string
+}
+
 // CredentialValidator stores the authentication data of a socks5 proxy
 type CredentialValidator struct {
 	username string
@@ -55,20 +62,23 @@ func (d *VirtualTun) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 
 		status := http.StatusOK
-		for _, record := range d.PingRecord {
-			lastPong := time.Unix(int64(record), 0)
-			// +2 seconds to account for the time it takes to ping the IP
-			if time.Since(lastPong) > time.Duration(d.Conf.CheckAliveInterval+2)*time.Second {
-				status = http.StatusServiceUnavailable
-				break
-			}
+		if !d.pingHealthy() {
+			status = http.StatusServiceUnavailable
 		}
 
 		w.WriteHeader(status)
 		_, _ = w.Write(body)
 		_, _ = w.Write([]byte("\n"))
+	case pacPath:
+		if d.PAC == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", pacContentType)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(d.pacFile(r.Host))
 	case "/metrics":
-		get, err := d.Dev.IpcGet()
+		get, err := d.currentDevice().IpcGet()
 		if err != nil {
 			d.Logger.Errorf("Failed to get device metrics: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -90,6 +100,15 @@ func (d *VirtualTun) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			buf.WriteString("\n")
 		}
 
+		names := make([]string, 0, len(d.Users))
+		for name := range d.Users {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			d.Users[name].writeMetrics(&buf)
+		}
+
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write(buf.Bytes())
 	default:
@@ -97,9 +116,23 @@ func (d *VirtualTun) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// pingHealthy reports whether every CheckAlive address answered within the last interval
+func (d *VirtualTun) pingHealthy() bool {
+	d.PingRecordLock.Lock()
+	defer d.PingRecordLock.Unlock()
+	for _, record := range d.PingRecord {
+		lastPong := time.Unix(int64(record), 0)
+		// +2 seconds to account for the time it takes to ping the IP
+		if time.Since(lastPong) > time.Duration(d.Conf.CheckAliveInterval+2)*time.Second {
+			return false
+		}
+	}
+	return true
+}
+
 func (d *VirtualTun) pingIPs() {
 	for _, addr := range d.Conf.CheckAlive {
-		socket, err := d.Tnet.Dial("ping", addr.String())
+		socket, err := d.currentNet().Dial("ping", addr.String())
 		if err != nil {
 			d.Logger.Errorf("Failed to ping %s: %v", addr, err)
 			continue
@@ -181,6 +214,19 @@ func (d *VirtualTun) pingIPs() {
 }
 
 func (d *VirtualTun) StartPingIPs() {
+	d.startPinging()
+
+	for _, standby := range d.Standby {
+		standby.startPinging()
+	}
+	for _, tunnel := range d.Tunnels {
+		if tunnel != d {
+			tunnel.startPinging()
+		}
+	}
+}
+
+func (d *VirtualTun) startPinging() {
 	for _, addr := range d.Conf.CheckAlive {
 		d.PingRecord[addr.String()] = 0
 	}
@@ -188,69 +234,35 @@ func (d *VirtualTun) StartPingIPs() {
 	go func() {
 		for {
 			d.pingIPs()
-			time.Sleep(time.Duration(d.Conf.CheckAliveInterval) * time.Second)
+			if !d.sleep(d.checkAliveInterval()) {
+				return
+			}
 		}
 	}()
+
+	if d.Conf.RestartThreshold > 0 {
+		go d.watchdog()
+	}
 }
 
 // SpawnRoutine spawns a socks5 server.
 func (config *Socks5Config) SpawnRoutine(ctx context.Context, vt *VirtualTun) error {
+	tunnels, err := vt.newBalancer(config.TunnelSelection)
+	if err != nil {
+		return err
+	}
 	logger := vt.Logger
 	logger.Verbosef("SOCKS5 SpawnRoutine started for bindAddress %s", config.BindAddress)
-	var authMethods []socks5.Authenticator
-	if username := config.Username; username != "" {
-		logger.Verbosef("SOCKS5 using authentication with username %s", username)
-		authMethods = append(authMethods, socks5.UserPassAuthenticator{
-			Credentials: socks5.StaticCredentials{username: config.Password},
-		})
+	credentials, err := newProxyCredentials(ctx, config.Username, config.Password, config.UsersFile, logger)
+	if err != nil {
+		return err
+	}
+	if credentials != nil {
+		logger.Verbosef("SOCKS5 using authentication with username %s and users file %s", config.Username, config.UsersFile)
 	} else {
 		logger.Verbosef("SOCKS5 using no authentication")
-		authMethods = append(authMethods, socks5.NoAuthAuthenticator{})
 	}
-
-	r := &TUNResolver{vt: vt}
-	options := []socks5.Option{
-		socks5.WithDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
-			host, port, err := net.SplitHostPort(addr)
-			if err != nil {
-				return nil, err
-			}
-
-			ip := net.ParseIP(host)
-			if ip == nil {
-				// Domain name, resolve using TUNResolver
-				_, resolvedIP, err := r.Resolve(ctx, host)
-				if err != nil {
-					return nil, err
-				}
-				addr = net.JoinHostPort(resolvedIP.String(), port)
-			} else {
-				// Prefer IPv4
-				if ip.To4() == nil {
-					// Try to resolve an IPv4 if available
-					_, ipv4Addr, err := r.Resolve(ctx, host)
-					if err == nil && ipv4Addr.To4() != nil {
-						addr = net.JoinHostPort(ipv4Addr.String(), port)
-					}
-				}
-			}
-			conn, err := vt.Tnet.DialContext(ctx, network, addr)
-			if err != nil {
-				vt.Logger.Errorf("DialContext failed for %s %s: %v", network, addr, err)
-				return nil, err
-			}
-			if conn == nil {
-				err = errors.New("DialContext returned nil conn without error")
-				vt.Logger.Errorf("Invalid dial for %s %s: %v", network, addr, err)
-				return nil, err
-			}
-			return conn, nil
-		}),
-		socks5.WithResolver(r),
-		socks5.WithAuthMethods(authMethods),
-		socks5.WithBufferPool(bufferpool.NewPool(256 * 1024))}
-
-	server := socks5.NewServer(options...)
+	server := newSocks5Server(vt, tunnels, credentials, &authLockout{})
 	logger.Verbosef("SOCKS5 server object created")
 
 	listener, err := net.Listen("tcp", config.BindAddress)
@@ -258,6 +270,7 @@ func (config *Socks5Config) SpawnRoutine(ctx context.Context, vt *VirtualTun) er
 		logger.Errorf("SOCKS5 net.Listen failed: %v", err)
 		return err
 	}
+	listener = listenAllowed(listener, config.AllowFrom, logger)
 	logger.Verbosef("SOCKS5 listener bound successfully on %s", config.BindAddress)
 
 	go func() {
@@ -284,36 +297,91 @@ func (config *Socks5Config) SpawnRoutine(ctx context.Context, vt *VirtualTun) er
 					logger.Errorf("SOCKS5 network connect close failed: %v", err)
 				}
 			}(conn)
-			if err := server.ServeConn(conn); err != nil {
-				if !strings.Contains(err.Error(), "connection reset by peer") &&
-					err != io.EOF &&
-					!strings.Contains(err.Error(), "operation aborted") && // read/write aborts
-					!errors.Is(err, net.ErrClosed) && // Closed connections
-					!errors.Is(err, context.Canceled) { // Context shutdown
-					logger.Errorf("SOCKS5 ServeConn error for %s: %v", conn.RemoteAddr(), err)
-				}
-			}
+			serveSocks5Conn(server, conn, logger)
 		}(conn)
 	}
 }
 
+// newSocks5Server returns a socks5 server dialing through tunnels, authenticating
+// the clients with credentials unless it is nil and counting their failures in lockout
+func newSocks5Server(vt *VirtualTun, tunnels *balancer, credentials credentialChecker, lockout *authLockout) *socks5.Server {
+	var authMethods []socks5.Authenticator
+	if credentials != nil {
+		authMethods = append(authMethods, socks5.UserPassAuthenticator{
+			Credentials: socksCredentials{credentials, lockout},
+		})
+	} else {
+		authMethods = append(authMethods, socks5.NoAuthAuthenticator{})
+	}
+
+	options := []socks5.Option{
+		socks5.WithDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return vt.dialUser(ctx, tunnels, userFrom(ctx), network, addr)
+		}),
+		socks5.WithResolver(deferredResolver{}),
+		socks5.WithRule(routeRuleSet{vt: vt}),
+		socks5.WithBindHandle(socks5Bind(vt, tunnels)),
+		socks5.WithAuthMethods(authMethods),
+		socks5.WithBufferPool(bufferpool.NewPool(256 * 1024))}
+
+	return socks5.NewServer(options...)
+}
+
+// serveSocks5Conn serves a socks5 connection, logging the errors other than disconnections
+func serveSocks5Conn(server *socks5.Server, conn net.Conn, logger *device.Logger) {
+	if err := server.ServeConn(conn); err != nil {
+		if !strings.Contains(err.Error(), "connection reset by peer") &&
+			err != io.EOF &&
+			!strings.Contains(err.Error(), "operation aborted") && // read/write aborts
+			!errors.Is(err, net.ErrClosed) && // Closed connections
+			!errors.Is(err, context.Canceled) { // Context shutdown
+			logger.Errorf("SOCKS5 ServeConn error for %s: %v", conn.RemoteAddr(), err)
+		}
+	}
+}
+
 // SpawnRoutine spawns an http server.
 func (config *HTTPConfig) SpawnRoutine(ctx context.Context, vt *VirtualTun) error {
+	tunnels, err := vt.newBalancer(config.TunnelSelection)
+	if err != nil {
+		return err
+	}
 	logger := vt.Logger
 	logger.Verbosef("HTTP SpawnRoutine started for bindAddress %s", config.BindAddress)
 
+	credentials, err := newProxyCredentials(ctx, config.Username, config.Password, config.UsersFile, logger)
+	if err != nil {
+		return err
+	}
+
 	server := &HTTPServer{
-		config:       config,
-		dial:         vt.Tnet.Dial,
-		auth:         CredentialValidator{config.Username, config.Password},
+		config: config,
+		dial: func(user, network, address string) (net.Conn, error) {
+			return vt.dialUser(context.Background(), tunnels, user, network, address)
+		},
+		auth:         credentials,
 		logger:       logger,
-		authRequired: config.Username != "" || config.Password != "",
+		authRequired: credentials != nil,
+		lockout:      &authLockout{},
+	}
+	if vt.PAC != nil {
+		server.pac = vt.pacFile
 	}
 	if server.authRequired {
-		logger.Verbosef("HTTP using authentication with username %s", config.Username)
+		logger.Verbosef("HTTP using authentication with username %s and users file %s", config.Username, config.UsersFile)
 	} else {
 		logger.Verbosef("HTTP using no authentication")
 	}
 
+	if config.CertFile != "" {
+		certs, err := loadCertStore(config.CertFile, config.KeyFile, config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		go certs.watch(ctx, logger)
+		server.tls = certs.tlsConfig(server.authRequired)
+		logger.Verbosef("HTTP using TLS with certificate %s and client CA %s", config.CertFile, config.ClientCAFile)
+	}
+
 	return server.ListenAndServe(ctx, "tcp", config.BindAddress)
 }
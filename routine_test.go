@@ -0,0 +1,53 @@
+package wireproxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+	"github.com/amnezia-vpn/amneziawg-go/tun/netstack"
+)
+
+// startTestDevice returns a tunnel on a netstack device with address, without peers
+func startTestDevice(t *testing.T, address netip.Addr) *VirtualTun {
+	t.Helper()
+	_, tnet, err := netstack.CreateNetTUN([]netip.Addr{address}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &VirtualTun{
+		Tnet:   tnet,
+		Logger: device.NewLogger(device.LogLevelSilent, ""),
+		Conf:   &DeviceConfig{Address: []netip.Addr{address}},
+	}
+}
+
+// startTestProxy serves a single client connection with serve in the background, returning
+// the client end of the connection and a channel closed once serve returns
+func startTestProxy(t *testing.T, serve func(conn net.Conn)) (net.Conn, <-chan struct{}) {
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() {
+		_ = clientConn.Close()
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(serverConn)
+		_ = serverConn.Close()
+	}()
+	return clientConn, done
+}
+
+// pipeUpstream returns the proxy end of a connection whose other end, standing for the
+// destination of the proxy, is handled by upstream in the background
+func pipeUpstream(upstream func(peer net.Conn)) net.Conn {
+	conn, peer := net.Pipe()
+	go upstream(peer)
+	return conn
+}
+
+// closeUpstream is an upstream closing the connection right away
+func closeUpstream(peer net.Conn) {
+	_ = peer.Close()
+}
@@ -0,0 +1,120 @@
+package wireproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+// secretCommandTimeout bounds the time an exec: secret reference may take
+const secretCommandTimeout = 10 * time.Second
+
+// secretReferencePrefixes are the prefixes of the secret values read from a file or a command
+var secretReferencePrefixes = []string{"file:", "exec:"}
+
+// parseSecret reads the secret keyName, or the content of the file named by keyName + "File",
+// such as PrivateKeyFile for PrivateKey. A value starting with file: or exec: is read from a
+// file or from the output of a command, unlike the values of the other keys. A leading
+// backslash keeps such a value literal, as in \file:.
+func parseSecret(section *ini.Section, keyName string) (string, error) {
+	fileKey, err := section.GetKey(keyName + "File")
+	if err == nil {
+		if section.HasKey(keyName) {
+			return "", errors.New(keyName + " and " + keyName + "File cannot be both set")
+		}
+		return readSecretFile(fileKey.String())
+	}
+
+	if key, err := section.GetKey(keyName); err == nil {
+		if strings.HasPrefix(key.String(), `\`) && isSecretReference(key.String()) {
+			return key.String()[1:], nil
+		}
+		if path, ok := strings.CutPrefix(key.String(), "file:"); ok {
+			return readSecretFile(path)
+		}
+		if command, ok := strings.CutPrefix(key.String(), "exec:"); ok {
+			return execSecret(command)
+		}
+	}
+	return parseString(section, keyName)
+}
+
+// isSecretReference reports whether value, leading backslashes aside, starts with file: or exec:
+func isSecretReference(value string) bool {
+	value = strings.TrimLeft(value, `\`)
+	for _, prefix := range secretReferencePrefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkImportedValues rejects the values of cfg referencing environment variables, files or
+// commands, as a configuration imported from elsewhere must not read nor run anything locally
+func checkImportedValues(cfg *ini.File) error {
+	for _, section := range cfg.Sections() {
+		for _, key := range section.Keys() {
+			value := key.String()
+			if strings.HasPrefix(value, "$") {
+				return fmt.Errorf("%s of an imported configuration cannot reference an environment variable", key.Name())
+			}
+			for _, prefix := range secretReferencePrefixes {
+				if strings.HasPrefix(value, prefix) {
+					return fmt.Errorf("%s of an imported configuration cannot use %s", key.Name(), prefix)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// readSecretFile returns the content of a file holding a secret, without its trailing newline.
+// Environment variables are expanded in path, so that systemd credentials can be referenced
+// with $CREDENTIALS_DIRECTORY. The file must not be readable by other users.
+func readSecretFile(path string) (string, error) {
+	path = os.ExpandEnv(strings.TrimSpace(path))
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0o004 != 0 {
+		return "", fmt.Errorf("secret file %s must not be readable by other users", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// execSecret runs command, split on spaces and without a shell, and returns what it prints
+// without the trailing newline
+func execSecret(command string) (string, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", errors.New("exec: secret reference without a command")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), secretCommandTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("%s: %w: %s", args[0], err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("%s: %w", args[0], err)
+	}
+	return strings.TrimRight(string(output), "\r\n"), nil
+}
@@ -0,0 +1,202 @@
+package wireproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+const (
+	// sniffTimeout bounds the time a client of the SNI proxy has to tell the host it connects to
+	sniffTimeout = 10 * time.Second
+	// sniffMaxBytes bounds how much of a connection is read to find the host it connects to
+	sniffMaxBytes = 64 * 1024
+	// tlsRecordHandshake is the type of the TLS record carrying a ClientHello
+	tlsRecordHandshake = 0x16
+)
+
+var (
+	errSniffed      = errors.New("server name read")
+	errNoServerName = errors.New("no server name in the TLS ClientHello")
+)
+
+// sniffConn feeds the TLS handshake with the bytes read from reader, writing nothing to the client
+type sniffConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *sniffConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *sniffConn) Write([]byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// readServerName reads the server name of the TLS ClientHello sent on conn
+func readServerName(conn net.Conn, reader io.Reader) (string, error) {
+	var serverName string
+	err := tls.Server(&sniffConn{Conn: conn, reader: reader}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errSniffed
+		},
+	}).Handshake()
+	if !errors.Is(err, errSniffed) {
+		return "", err
+	}
+	if serverName == "" {
+		return "", errNoServerName
+	}
+	return serverName, nil
+}
+
+// sniffHost reads the beginning of conn to find the host it connects to, from the server
+// name of a TLS ClientHello or from the Host header of an HTTP request. port is only set
+// when the Host header holds one. The connection is returned with the bytes read put back.
+func sniffHost(conn net.Conn) (host string, port string, peeked net.Conn, err error) {
+	var recorded bytes.Buffer
+	reader := bufio.NewReader(io.TeeReader(io.LimitReader(conn, sniffMaxBytes), &recorded))
+	peeked = &peekedConn{Conn: conn, reader: io.MultiReader(&recorded, conn)}
+
+	first, err := reader.Peek(1)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if first[0] == tlsRecordHandshake {
+		host, err = readServerName(conn, reader)
+		return host, "", peeked, err
+	}
+
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if req.Host == "" {
+		return "", "", nil, errors.New("no Host header in the HTTP request")
+	}
+	host = req.Host
+	if h, p, err := net.SplitHostPort(req.Host); err == nil {
+		host, port = h, p
+	}
+	return host, port, peeked, nil
+}
+
+// sniServer forwards the connections to the host they ask for, if allowed
+type sniServer struct {
+	allowed *RouteRule
+	// targetPort is the port connected to, the local port of the connection when 0
+	targetPort uint16
+	dial       func(network, address string) (net.Conn, error)
+	logger     *device.Logger
+}
+
+// destination returns the address conn should be forwarded to, host being the name it asked for
+func (s *sniServer) destination(conn net.Conn, host, port string) (string, error) {
+	if port == "" {
+		target := s.targetPort
+		if target == 0 {
+			local, ok := conn.LocalAddr().(*net.TCPAddr)
+			if !ok {
+				return "", errors.New("unknown target port")
+			}
+			target = uint16(local.Port)
+		}
+		port = strconv.Itoa(int(target))
+	}
+
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", err
+	}
+	if !s.allowed.Match(host, uint16(portNumber)) {
+		return "", errors.New(net.JoinHostPort(host, port) + " is not allowed")
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// serve forwards conn to the host it asks for
+func (s *sniServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	host, port, peeked, err := sniffHost(conn)
+	if err != nil {
+		if err != io.EOF {
+			s.logger.Errorf("SNIProxy reading the host of %s failed: %v", conn.RemoteAddr(), err)
+		}
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	address, err := s.destination(conn, host, port)
+	if err != nil {
+		s.logger.Errorf("SNIProxy rejected %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	peer, err := s.dial("tcp", address)
+	if err != nil {
+		s.logger.Errorf("SNIProxy connect to %s failed: %v", address, err)
+		return
+	}
+	defer peer.Close()
+
+	relay(peeked, peer)
+}
+
+// SpawnRoutine spawns an SNI proxy, forwarding the connections through the tunnel to the
+// host named by their TLS ClientHello or HTTP Host header.
+func (config *SNIProxyConfig) SpawnRoutine(ctx context.Context, vt *VirtualTun) error {
+	tunnels, err := vt.newBalancer(config.TunnelSelection)
+	if err != nil {
+		return err
+	}
+	logger := vt.Logger
+	logger.Verbosef("SNIProxy SpawnRoutine started for bindAddress %s", config.BindAddress)
+
+	server := &sniServer{
+		allowed:    &config.Allowed,
+		targetPort: config.TargetPort,
+		dial: func(network, address string) (net.Conn, error) {
+			return vt.dialRouted(context.Background(), tunnels, network, address)
+		},
+		logger: logger,
+	}
+
+	listener, err := net.Listen("tcp", config.BindAddress)
+	if err != nil {
+		logger.Errorf("SNIProxy net.Listen failed: %v", err)
+		return err
+	}
+	listener = listenAllowed(listener, config.AllowFrom, logger)
+	logger.Verbosef("SNIProxy listener bound successfully on %s", config.BindAddress)
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				logger.Verbosef("SNIProxy accept loop exited gracefully on listener close")
+				return nil
+			}
+			logger.Errorf("SNIProxy accept error: %v", err)
+			return err
+		}
+		go server.serve(conn)
+	}
+}
@@ -0,0 +1,68 @@
+package wireproxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+func TestSNIProxy(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		client  func(conn net.Conn)
+		address string
+		prefix  string
+	}{
+		{"TLS", func(conn net.Conn) {
+			_ = tls.Client(conn, &tls.Config{ServerName: "www.example.com"}).Handshake()
+		}, "www.example.com:443", "\x16\x03"},
+		{"HTTP", func(conn net.Conn) {
+			_, _ = conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com:8080\r\n\r\n"))
+		}, "example.com:8080", "GET / HTTP/1.1\r\nHost: example.com:8080\r\n\r\n"},
+		{"name not allowed", func(conn net.Conn) {
+			_ = tls.Client(conn, &tls.Config{ServerName: "example.org"}).Handshake()
+		}, "", ""},
+		{"port not allowed", func(conn net.Conn) {
+			_, _ = conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com:22\r\n\r\n"))
+		}, "", ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var address string
+			received := make(chan []byte, 1)
+			server := &sniServer{
+				allowed: &RouteRule{
+					Domains: []string{"example.com"},
+					Ports:   []PortRange{{Start: 443, End: 443}, {Start: 8080, End: 8080}},
+				},
+				targetPort: 443,
+				dial: func(_, a string) (net.Conn, error) {
+					address = a
+					return pipeUpstream(func(peer net.Conn) {
+						data := make([]byte, len(test.prefix))
+						_, _ = io.ReadFull(peer, data)
+						received <- data
+						_ = peer.Close()
+					}), nil
+				},
+				logger: device.NewLogger(device.LogLevelSilent, ""),
+			}
+
+			clientConn, done := startTestProxy(t, server.serve)
+			go test.client(clientConn)
+			<-done
+			_ = clientConn.Close()
+
+			if address != test.address {
+				t.Errorf("unexpected destination %q", address)
+			}
+			if test.address != "" {
+				if data := <-received; string(data) != test.prefix {
+					t.Errorf("unexpected forwarded data %q", data)
+				}
+			}
+		})
+	}
+}
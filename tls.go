@@ -0,0 +1,179 @@
+package wireproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+// certReloadInterval is how often the certificate files of a proxy are checked for changes
+const certReloadInterval = 30 * time.Second
+
+// tlsHandshakeTimeout bounds the TLS handshake of the clients of a proxy
+const tlsHandshakeTimeout = 10 * time.Second
+
+// certStore holds the certificate of a TLS proxy and the CAs of its client certificates,
+// reloading them when their files change
+type certStore struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	lock      sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	// infos are the files as they were last read, to notice when they are modified or replaced
+	infos [3]os.FileInfo
+}
+
+// loadCertStore reads the certificate and key of a proxy, and the client CAs when clientCAFile is set
+func loadCertStore(certFile, keyFile, clientCAFile string) (*certStore, error) {
+	s := &certStore{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// files returns the files of the store, an empty name standing for an unused file
+func (s *certStore) files() [3]string {
+	return [3]string{s.certFile, s.keyFile, s.clientCAFile}
+}
+
+// reload reads the files again, keeping the current certificates when they are invalid
+func (s *certStore) reload() error {
+	var infos [3]os.FileInfo
+	for i, file := range s.files() {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		infos[i] = info
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if s.clientCAFile != "" {
+		data, err := os.ReadFile(s.clientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return errors.New("no certificate found in " + s.clientCAFile)
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cert = &cert
+	s.clientCAs = clientCAs
+	s.infos = infos
+	return nil
+}
+
+// changed reports whether one of the files was modified or replaced since they were last read.
+// Besides the modification time, the size and the inode are compared, since a file may be
+// replaced by one with the same modification time, like a renewed certificate copied with it.
+func (s *certStore) changed() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for i, file := range s.files() {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		previous := s.infos[i]
+		if !os.SameFile(info, previous) || !info.ModTime().Equal(previous.ModTime()) || info.Size() != previous.Size() {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the files whenever they change, until ctx is done
+func (s *certStore) watch(ctx context.Context, logger *device.Logger) {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !s.changed() {
+			continue
+		}
+		if err := s.reload(); err != nil {
+			logger.Errorf("Failed to reload certificate %s, keeping the previous one: %v", s.certFile, err)
+			continue
+		}
+		logger.Verbosef("Reloaded certificate %s", s.certFile)
+	}
+}
+
+// tlsConfig returns a TLS configuration using the current certificates at every handshake.
+// Client certificates are required unless optional is set, in which case the clients
+// may authenticate with a password instead.
+func (s *certStore) tlsConfig(optional bool) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s.lock.RLock()
+			defer s.lock.RUnlock()
+
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*s.cert},
+			}
+			if s.clientCAs != nil {
+				config.ClientCAs = s.clientCAs
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				if optional {
+					config.ClientAuth = tls.VerifyClientCertIfGiven
+				}
+			}
+			return config, nil
+		},
+	}
+}
+
+// certificateUser returns the user named by the common name of the verified client
+// certificate of conn, empty when conn is not a TLS connection or has no client certificate
+func certificateUser(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	// The handshake is bounded so that a client cannot hold the connection without completing it
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return "", err
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return "", nil
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName, nil
+}
@@ -0,0 +1,167 @@
+package wireproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+// writeTestCertificate writes a certificate for name signed by ca, or self-signed when ca is nil,
+// returning it along with its key pair
+func writeTestCertificate(t *testing.T, dir, name string, ca *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := template, any(key)
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestHTTPSProxy(t *testing.T) {
+	dir := t.TempDir()
+	ca := writeTestCertificate(t, dir, "ca", nil)
+	writeTestCertificate(t, dir, "localhost", &ca)
+	client := writeTestCertificate(t, dir, "alice", &ca)
+
+	config := `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+
+[http]
+BindAddress = 127.0.0.1:25345
+CertFile = ` + filepath.Join(dir, "localhost.crt") + `
+KeyFile = ` + filepath.Join(dir, "localhost.key") + `
+ClientCAFile = ` + filepath.Join(dir, "ca.crt")
+	conf, err := ParseConfigString(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpConfig := conf.Routines[0].(*HTTPConfig)
+
+	certs, err := loadCertStore(httpConfig.CertFile, httpConfig.KeyFile, httpConfig.ClientCAFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := make(chan string, 1)
+	server := &HTTPServer{
+		config: httpConfig,
+		dial: func(user, _, _ string) (net.Conn, error) {
+			users <- user
+			return pipeUpstream(closeUpstream), nil
+		},
+		logger:  device.NewLogger(device.LogLevelSilent, ""),
+		tls:     certs.tlsConfig(false),
+		lockout: &authLockout{},
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	clientConn, _ := startTestProxy(t, func(conn net.Conn) {
+		server.serve(tls.Server(conn, server.tls))
+	})
+	conn := tls.Client(clientConn, &tls.Config{RootCAs: roots, ServerName: "localhost", Certificates: []tls.Certificate{client}})
+	defer conn.Close()
+	if _, err := conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(status, "HTTP/1.1 200") {
+		t.Errorf("unexpected response: %s", status)
+	}
+	if user := <-users; user != "alice" {
+		t.Errorf("unexpected user: %s", user)
+	}
+
+	previous := certs.cert
+	writeTestCertificate(t, dir, "localhost", &ca)
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(httpConfig.CertFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if !certs.changed() {
+		t.Fatal("certificate change not detected")
+	}
+	if err := certs.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if certs.cert == previous || bytes.Equal(certs.cert.Certificate[0], previous.Certificate[0]) {
+		t.Error("certificate not reloaded")
+	}
+
+	// A certificate moved in place keeping the modification time of the previous one is a change too
+	renewed := t.TempDir()
+	writeTestCertificate(t, renewed, "localhost", &ca)
+	for _, name := range []string{"localhost.crt", "localhost.key"} {
+		if err := os.Chtimes(filepath.Join(renewed, name), later, later); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(filepath.Join(renewed, name), filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !certs.changed() {
+		t.Fatal("replaced certificate not detected")
+	}
+
+	if _, err := ParseConfigString(strings.Replace(config, "KeyFile", "#KeyFile", 1)); err == nil {
+		t.Error("CertFile without KeyFile accepted")
+	}
+}
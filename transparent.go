@@ -0,0 +1,87 @@
+package wireproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+var errNotRedirected = errors.New("connection was not redirected to the transparent proxy")
+
+// transparentServer forwards the connections redirected to a transparent proxy
+type transparentServer struct {
+	dial func(network, address string) (net.Conn, error)
+	// destination returns the address a connection was originally sent to
+	destination func(conn net.Conn) (netip.AddrPort, error)
+	logger      *device.Logger
+}
+
+// serve forwards conn to its original destination
+func (s *transparentServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	destination, err := s.destination(conn)
+	if err != nil {
+		s.logger.Errorf("TransparentTCP original destination of %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	peer, err := s.dial("tcp", destination.String())
+	if err != nil {
+		s.logger.Errorf("TransparentTCP connect to %s failed: %v", destination, err)
+		return
+	}
+	defer peer.Close()
+
+	relay(conn, peer)
+}
+
+// SpawnRoutine spawns a transparent proxy forwarding the connections redirected to it by
+// iptables through the tunnel. It is only supported on Linux.
+func (config *TransparentTCPConfig) SpawnRoutine(ctx context.Context, vt *VirtualTun) error {
+	tunnels, err := vt.newBalancer(config.TunnelSelection)
+	if err != nil {
+		return err
+	}
+	logger := vt.Logger
+	logger.Verbosef("TransparentTCP SpawnRoutine started for bindAddress %s", config.BindAddress)
+
+	server := &transparentServer{
+		dial: func(network, address string) (net.Conn, error) {
+			return vt.dialRouted(context.Background(), tunnels, network, address)
+		},
+		destination: func(conn net.Conn) (netip.AddrPort, error) {
+			return originalDestination(conn, config.TProxy)
+		},
+		logger: logger,
+	}
+
+	listener, err := listenTransparent(ctx, config.BindAddress, config.TProxy)
+	if err != nil {
+		logger.Errorf("TransparentTCP listen failed: %v", err)
+		return err
+	}
+	listener = listenAllowed(listener, config.AllowFrom, logger)
+	logger.Verbosef("TransparentTCP listener bound successfully on %s", config.BindAddress)
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				logger.Verbosef("TransparentTCP accept loop exited gracefully on listener close")
+				return nil
+			}
+			logger.Errorf("TransparentTCP accept error: %v", err)
+			return err
+		}
+		go server.serve(conn)
+	}
+}
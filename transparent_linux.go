@@ -0,0 +1,100 @@
+//go:build linux
+
+package wireproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST of linux/netfilter_ipv4.h, IP6T_SO_ORIGINAL_DST having the same value
+const soOriginalDst = 80
+
+// listenTransparent listens for the connections redirected to bindAddress, setting
+// IP_TRANSPARENT on the socket when tproxy is set, which needs CAP_NET_ADMIN
+func listenTransparent(ctx context.Context, bindAddress string, tproxy bool) (net.Listener, error) {
+	var config net.ListenConfig
+	if tproxy {
+		config.Control = func(network, _ string, conn syscall.RawConn) error {
+			var err error
+			controlErr := conn.Control(func(fd uintptr) {
+				if network == "tcp6" {
+					if err = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1); err != nil {
+						return
+					}
+				}
+				// IPv4 connections reach dual stack sockets too
+				err = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+			})
+			if controlErr != nil {
+				return controlErr
+			}
+			return err
+		}
+	}
+	return config.Listen(ctx, "tcp", bindAddress)
+}
+
+// originalDestination returns the address conn was sent to before being redirected to
+// the transparent proxy. TPROXY keeps it as the local address of the connection while
+// REDIRECT rewrites it, the original one being kept by conntrack.
+func originalDestination(conn net.Conn, tproxy bool) (netip.AddrPort, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return netip.AddrPort{}, errors.New("not a TCP connection")
+	}
+	local := tcpConn.LocalAddr().(*net.TCPAddr).AddrPort()
+	local = netip.AddrPortFrom(local.Addr().Unmap(), local.Port())
+	if tproxy {
+		return local, nil
+	}
+
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	var destination netip.AddrPort
+	controlErr := raw.Control(func(fd uintptr) {
+		destination, err = getOriginalDst(int(fd), local.Addr().Is4())
+	})
+	if controlErr != nil {
+		return netip.AddrPort{}, controlErr
+	}
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	// Without conntrack entry the connection was made to the proxy itself
+	if destination == local {
+		return netip.AddrPort{}, errNotRedirected
+	}
+	return destination, nil
+}
+
+// getOriginalDst reads SO_ORIGINAL_DST from fd. The getsockopt helpers of the unix
+// package are used for their buffers, large enough for a sockaddr_in and a sockaddr_in6.
+func getOriginalDst(fd int, ipv4 bool) (netip.AddrPort, error) {
+	if ipv4 {
+		mreq, err := unix.GetsockoptIPv6Mreq(fd, unix.SOL_IP, soOriginalDst)
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		// sockaddr_in: family, port and address in network byte order
+		sockaddr := mreq.Multiaddr[:]
+		addr := netip.AddrFrom4([4]byte(sockaddr[4:8]))
+		return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(sockaddr[2:4])), nil
+	}
+
+	info, err := unix.GetsockoptIPv6MTUInfo(fd, unix.SOL_IPV6, soOriginalDst)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	// The port of a RawSockaddrInet6 is stored in network byte order
+	port := binary.BigEndian.Uint16(binary.NativeEndian.AppendUint16(nil, info.Addr.Port))
+	return netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr).Unmap(), port), nil
+}
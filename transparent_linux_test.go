@@ -0,0 +1,62 @@
+//go:build linux
+
+package wireproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+func TestTransparentTCP(t *testing.T) {
+	var address string
+	server := &transparentServer{
+		dial: func(_, a string) (net.Conn, error) {
+			address = a
+			return pipeUpstream(func(peer net.Conn) {
+				_, _ = peer.Write([]byte("hello"))
+				_ = peer.Close()
+			}), nil
+		},
+		destination: func(net.Conn) (netip.AddrPort, error) {
+			return netip.MustParseAddrPort("[2001:db8::1]:443"), nil
+		},
+		logger: device.NewLogger(device.LogLevelSilent, ""),
+	}
+
+	clientConn, _ := startTestProxy(t, server.serve)
+	data, err := io.ReadAll(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" || address != "[2001:db8::1]:443" {
+		t.Errorf("unexpected relay: %q to %q", data, address)
+	}
+
+	// A connection made to the proxy itself has no original destination
+	listener, err := listenTransparent(context.Background(), "127.0.0.1:0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if destination, err := originalDestination(conn, false); err == nil {
+		t.Errorf("unexpected original destination %s", destination)
+	}
+	if destination, err := originalDestination(conn, true); err != nil || destination.String() != listener.Addr().String() {
+		t.Errorf("unexpected TPROXY destination %s: %v", destination, err)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package wireproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+)
+
+var errTransparentUnsupported = errors.New("transparent proxying is only supported on Linux")
+
+func listenTransparent(context.Context, string, bool) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+func originalDestination(net.Conn, bool) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errTransparentUnsupported
+}
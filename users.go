@@ -0,0 +1,247 @@
+package wireproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// usersReloadInterval is how often a users file is checked for changes
+const usersReloadInterval = 5 * time.Second
+
+// dummyPasswordHash is checked for unknown users, so that they take as long to reject
+// as known users with a wrong password
+const dummyPasswordHash = "$2a$10$6JJq/U4/vGbjzz5gqdPbQuzmEPumbDMMUwb9kvcvhYj3H/ldlSOJW"
+
+// credentialChecker validates the credentials given to a proxy
+type credentialChecker interface {
+	Valid(username, password string) bool
+}
+
+// UserStore validates credentials against an htpasswd style file of `user:hash` lines,
+// the hashes being bcrypt or argon2 ones
+type UserStore struct {
+	path string
+
+	lock    sync.RWMutex
+	users   map[string]string
+	modTime time.Time
+	size    int64
+	// verified caches the passwords that matched their hash, as hashes are slow to check on purpose
+	verified map[string][sha256.Size]byte
+}
+
+// LoadUserStore reads the users file at path
+func LoadUserStore(path string) (*UserStore, error) {
+	s := &UserStore{path: path}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload reads the users file again, keeping the current users when it is invalid
+func (s *UserStore) reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			return fmt.Errorf("%s:%d: user:hash expected", s.path, lineNumber)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "$argon2") {
+			return fmt.Errorf("%s:%d: the password of %s must be hashed with bcrypt or argon2", s.path, lineNumber, username)
+		}
+		users[username] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.users = users
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	s.verified = make(map[string][sha256.Size]byte)
+	return nil
+}
+
+// changed reports whether the users file was modified since it was last read
+func (s *UserStore) changed() bool {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return false
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return !info.ModTime().Equal(s.modTime) || info.Size() != s.size
+}
+
+// watch reloads the users file whenever it changes, until ctx is done
+func (s *UserStore) watch(ctx context.Context, logger *device.Logger) {
+	ticker := time.NewTicker(usersReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !s.changed() {
+			continue
+		}
+		if err := s.reload(); err != nil {
+			logger.Errorf("Failed to reload users file, keeping the previous users: %v", err)
+			continue
+		}
+		logger.Verbosef("Reloaded users file %s", s.path)
+	}
+}
+
+// Valid checks password against the hash of username
+func (s *UserStore) Valid(username, password string) bool {
+	sum := sha256.Sum256([]byte(password))
+
+	s.lock.RLock()
+	hash, ok := s.users[username]
+	cached, verified := s.verified[username]
+	s.lock.RUnlock()
+	if !ok {
+		checkPasswordHash(dummyPasswordHash, password)
+		return false
+	}
+	if verified && subtle.ConstantTimeCompare(cached[:], sum[:]) == 1 {
+		return true
+	}
+
+	if !checkPasswordHash(hash, password) {
+		return false
+	}
+
+	s.lock.Lock()
+	if s.users[username] == hash {
+		s.verified[username] = sum
+	}
+	s.lock.Unlock()
+	return true
+}
+
+// checkPasswordHash reports whether password matches a bcrypt or argon2 hash
+func checkPasswordHash(hash, password string) bool {
+	if strings.HasPrefix(hash, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>, the salt and key being unpadded base64
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+
+	var derived []byte
+	switch parts[1] {
+	case "argon2id":
+		derived = argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	case "argon2i":
+		derived = argon2.Key([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare(derived, key) == 1
+}
+
+// proxyCredentials accepts the Username and Password of a proxy as well as the users of its UsersFile
+type proxyCredentials struct {
+	static *CredentialValidator
+	users  *UserStore
+}
+
+func (c proxyCredentials) Valid(username, password string) bool {
+	if c.static != nil && c.static.Valid(username, password) {
+		return true
+	}
+	return c.users != nil && c.users.Valid(username, password)
+}
+
+// socksCredentials adapts a credentialChecker to the socks5 package
+type socksCredentials struct {
+	checker credentialChecker
+	lockout *authLockout
+}
+
+func (c socksCredentials) Valid(username, password, userAddr string) bool {
+	// The clients connected otherwise than over TCP have no address, and are not locked out
+	client, _ := netip.ParseAddrPort(userAddr)
+	return c.lockout.validate(c.checker, client.Addr().Unmap(), username, password) == nil
+}
+
+// newProxyCredentials returns the credentials of a proxy, nil when it requires no authentication.
+// The users file is watched for changes until ctx is done.
+func newProxyCredentials(ctx context.Context, username, password, usersFile string, logger *device.Logger) (credentialChecker, error) {
+	var credentials proxyCredentials
+	if username != "" || password != "" {
+		credentials.static = &CredentialValidator{username, password}
+	}
+	if usersFile != "" {
+		users, err := LoadUserStore(usersFile)
+		if err != nil {
+			return nil, err
+		}
+		credentials.users = users
+		go users.watch(ctx, logger)
+	}
+
+	if credentials.static == nil && credentials.users == nil {
+		return nil, nil
+	}
+	return credentials, nil
+}
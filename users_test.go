@@ -0,0 +1,120 @@
+package wireproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestDummyPasswordHash(t *testing.T) {
+	// Unknown users are checked against the dummy hash, which must cost as much as a real one
+	cost, err := bcrypt.Cost([]byte(dummyPasswordHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost != bcrypt.DefaultCost {
+		t.Errorf("dummy hash cost %d, expected %d", cost, bcrypt.DefaultCost)
+	}
+
+	store := &UserStore{users: map[string]string{}}
+	if store.Valid("nobody", "wireproxy-dummy-password") {
+		t.Error("the dummy hash should not validate unknown users")
+	}
+}
+
+func TestProxyUsersFile(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("0123456789abcdef")
+	argon2Hash := "$argon2id$v=19$m=1024,t=1,p=1$" + base64.RawStdEncoding.EncodeToString(salt) + "$" +
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("hunter2"), salt, 1, 1024, 1, 32))
+
+	usersFile := filepath.Join(t.TempDir(), "users")
+	users := "# proxy users\nalice:" + string(bcryptHash) + "\nbob:" + argon2Hash + "\n"
+	if err := os.WriteFile(usersFile, []byte(users), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+
+[http]
+BindAddress = 127.0.0.1:25345
+Username = peter
+Password = static
+UsersFile = ` + usersFile
+	conf, err := ParseConfigString(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpConfig := conf.Routines[0].(*HTTPConfig)
+	if httpConfig.UsersFile != usersFile {
+		t.Fatalf("unexpected users file: %s", httpConfig.UsersFile)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	credentials, err := newProxyCredentials(ctx, httpConfig.Username, httpConfig.Password, httpConfig.UsersFile, device.NewLogger(device.LogLevelSilent, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		username, password string
+		valid              bool
+	}{
+		{"peter", "static", true},
+		{"alice", "secret", true},
+		{"alice", "secret", true},
+		{"bob", "hunter2", true},
+		{"alice", "hunter2", false},
+		{"bob", "secret", false},
+		{"carol", "secret", false},
+	} {
+		if valid := credentials.Valid(test.username, test.password); valid != test.valid {
+			t.Errorf("Valid(%s, %s) = %v, expected %v", test.username, test.password, valid, test.valid)
+		}
+	}
+
+	store, err := LoadUserStore(usersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(usersFile, []byte("bob:"+argon2Hash+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !store.changed() {
+		t.Fatal("users file change not detected")
+	}
+	if err := store.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if store.Valid("alice", "secret") || !store.Valid("bob", "hunter2") {
+		t.Error("users file not reloaded")
+	}
+
+	if err := os.WriteFile(usersFile, []byte("alice:secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.reload(); err == nil {
+		t.Error("plaintext password accepted")
+	}
+	if !store.Valid("bob", "hunter2") {
+		t.Error("previous users not kept after an invalid reload")
+	}
+	if _, err := ParseConfigString(config); err == nil {
+		t.Error("config with an invalid users file accepted")
+	}
+}
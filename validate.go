@@ -0,0 +1,449 @@
+package wireproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+// knownKeys lists the keys understood in each kind of section, the root section being ""
+var knownKeys = map[string][]string{
+	"": {"WGConfig", "Include"},
+	"interface": {
+		"PrivateKey", "PrivateKeyFile", "Address", "DNS", "MTU", "ListenPort",
+		"CheckAlive", "CheckAliveInterval", "RestartThreshold", "RestartMaxBackoff",
+		"DomainBlockingEnabled", "BlockedDomains",
+		"Jc", "Jmin", "Jmax", "S1", "S2", "S3", "S4",
+		"H1", "H2", "H3", "H4", "I1", "I2", "I3", "I4", "I5",
+		"OnUp", "OnDown", "OnHandshake", "OnHealthChange",
+		// wg-quick and wg keys, ignored as wireproxy sets up no network interface
+		"PreUp", "PostUp", "PreDown", "PostDown", "Table", "SaveConfig", "FwMark",
+	},
+	"peer":   {"PublicKey", "PreSharedKey", "PreSharedKeyFile", "Endpoint", "PersistentKeepalive", "AllowedIPs"},
+	"socks5": {"BindAddress", "Username", "Password", "PasswordFile", "UsersFile", "AllowFrom", "Device", "Balance", "Weights"},
+	"http": {
+		"BindAddress", "Username", "Password", "PasswordFile", "UsersFile", "AllowFrom",
+		"CertFile", "KeyFile", "ClientCAFile", "Device", "Balance", "Weights",
+	},
+	"mixed": {"BindAddress", "Username", "Password", "PasswordFile", "UsersFile", "AllowFrom", "Device", "Balance", "Weights"},
+	"pac":   {"Host", "Domain", "CIDR", "List"},
+	"rule":  {"Domain", "CIDR", "List", "Port", "Action"},
+	"user":  {"Name", "Domain", "CIDR", "List", "Port", "MaxConnections", "Bandwidth", "MonthlyQuota"},
+	"transparenttcp": {
+		"BindAddress", "AllowFrom", "TProxy", "Device", "Balance", "Weights",
+	},
+	"sniproxy": {
+		"BindAddress", "AllowFrom", "Domain", "CIDR", "List", "Port", "TargetPort", "Device", "Balance", "Weights",
+	},
+}
+
+// Diagnostic is a problem found in a configuration file. Line is 0 when the
+// problem is not tied to a line.
+type Diagnostic struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	if d.Line == 0 {
+		return d.File + ": " + d.Message
+	}
+	return fmt.Sprintf("%s:%d: %s", d.File, d.Line, d.Message)
+}
+
+// scannedKey is a key of a configuration file along with its line
+type scannedKey struct {
+	name string
+	line int
+}
+
+// scannedSection is a section of a configuration file along with its line and raw text
+type scannedSection struct {
+	file string
+	name string
+	line int
+	keys []scannedKey
+	text strings.Builder
+}
+
+// kind returns the section name without the device name of [Interface.<name>] and [Peer.<name>]
+func (s *scannedSection) kind() string {
+	kind, _, _ := strings.Cut(strings.ToLower(s.name), ".")
+	return kind
+}
+
+// load parses the section on its own
+func (s *scannedSection) load() (*ini.Section, error) {
+	cfg, err := ini.LoadSources(ini.LoadOptions{
+		Insensitive:            true,
+		AllowShadows:           true,
+		AllowNonUniqueSections: true,
+	}, []byte(s.text.String()))
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Section(s.name), nil
+}
+
+// keyLine returns the line of the last occurrence of key in the section, or the line of the section
+func (s *scannedSection) keyLine(key string) int {
+	line := s.line
+	for _, k := range s.keys {
+		if strings.EqualFold(k.name, key) {
+			line = k.line
+		}
+	}
+	return line
+}
+
+// scanINI splits an INI file into sections, keeping track of the line of every section and key
+func scanINI(data, file string) []*scannedSection {
+	current := &scannedSection{file: file}
+	sections := []*scannedSection{current}
+
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+			continue
+		case line[0] == '[':
+			name, _, _ := strings.Cut(line[1:], "]")
+			current = &scannedSection{file: file, name: strings.TrimSpace(name), line: lineNumber}
+			sections = append(sections, current)
+		default:
+			name, _, _ := strings.Cut(line, "=")
+			name, _, _ = strings.Cut(name, ":")
+			current.keys = append(current.keys, scannedKey{name: strings.TrimSpace(name), line: lineNumber})
+		}
+		current.text.WriteString(scanner.Text())
+		current.text.WriteByte('\n')
+	}
+	return sections
+}
+
+// ValidateConfig strictly checks the INI configuration file at path, see ValidateConfigString.
+// YAML and JSON files are only checked with Parse, without line numbers.
+func ValidateConfig(path string) ([]Diagnostic, error) {
+	if format := ConfigFormat(path); format != FormatINI {
+		if _, err := ParseConfigAs(path, format); err != nil {
+			return []Diagnostic{{File: path, Message: err.Error()}}, nil
+		}
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ValidateConfigString(string(data), path), nil
+}
+
+// ValidateConfigString strictly checks an INI configuration, file being the name used in the
+// diagnostics and the path relative Include patterns are resolved from. On top of the errors
+// reported by Parse, it reports unknown sections and keys, duplicate devices, peers with
+// overlapping AllowedIPs, proxies sharing a bind address and proxies whose device has no DNS
+// server to resolve the host names they are configured to reach. The INI files loaded by
+// Include and WGConfig are checked as well, with their own file names.
+func ValidateConfigString(config, file string) []Diagnostic {
+	v := &validator{
+		devices: make(map[string]*scannedSection),
+		peers:   make(map[string][]peerAt),
+	}
+
+	cfg, err := ini.LoadSources(ini.LoadOptions{
+		Insensitive:            true,
+		AllowShadows:           true,
+		AllowNonUniqueSections: true,
+	}, []byte(config))
+	if err != nil {
+		v.report(file, 0, "%v", err)
+		return v.diagnostics
+	}
+
+	v.tunnels, _, err = parseNamedDevices(cfg)
+	if err != nil {
+		v.tunnels = nil
+	}
+
+	v.checkFile(config, file)
+	if wgConf, err := cfg.Section("").GetKey("WGConfig"); err == nil {
+		for _, path := range wgConf.ValueWithShadows() {
+			if !IsAmneziaLink(path) {
+				v.checkIncludedFile(path)
+			}
+		}
+	}
+	// Errors loading the included files are reported by Parse below
+	if includes, err := loadIncludes(cfg, file, nil, make(map[string]bool)); err == nil {
+		for _, include := range includes {
+			if ConfigFormat(include.path) == FormatINI {
+				v.checkIncludedFile(include.path)
+			}
+		}
+	}
+
+	if len(v.diagnostics) == 0 {
+		v.checkConfiguration(cfg, file)
+	}
+
+	v.sort()
+	return v.diagnostics
+}
+
+type peerAt struct {
+	section *scannedSection
+	peer    PeerConfig
+}
+
+type routineAt struct {
+	section     *scannedSection
+	bindAddress string
+	selection   TunnelSelection
+	// hostNames tells whether the routine always dials host names, which needs a DNS server
+	hostNames bool
+	// domainTargets tells whether the routine dials the Domain targets of [Rule], [User] and [PAC]
+	domainTargets bool
+}
+
+// validator collects the diagnostics of a configuration and of the files it loads
+type validator struct {
+	diagnostics []Diagnostic
+	// files lists the checked files in order, to sort the diagnostics by file
+	files    []string
+	tunnels  map[string]*DeviceConfig
+	devices  map[string]*scannedSection
+	peers    map[string][]peerAt
+	routines []routineAt
+}
+
+func (v *validator) report(file string, line int, format string, args ...any) {
+	v.diagnostics = append(v.diagnostics, Diagnostic{File: file, Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+// location describes where section is, for a diagnostic of file
+func (v *validator) location(section *scannedSection, file string) string {
+	if section.file == file {
+		return fmt.Sprintf("line %d", section.line)
+	}
+	return fmt.Sprintf("%s:%d", section.file, section.line)
+}
+
+// checkIncludedFile checks the INI file at path, its read errors being left to Parse
+func (v *validator) checkIncludedFile(path string) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		v.checkFile(string(data), path)
+	}
+}
+
+// checkFile checks every section of an INI file on its own
+func (v *validator) checkFile(config, file string) {
+	v.files = append(v.files, file)
+
+	for _, section := range scanINI(config, file) {
+		keys, ok := knownKeys[section.kind()]
+		if !ok {
+			v.report(file, section.line, "unknown section [%s]", section.name)
+			continue
+		}
+		for _, key := range section.keys {
+			if !containsFold(keys, key.name) {
+				v.report(file, key.line, "unknown key %s in [%s]", key.name, section.name)
+			}
+		}
+		if section.name == "" {
+			continue
+		}
+
+		parsed, err := section.load()
+		if err != nil {
+			v.report(file, section.line, "[%s]: %v", section.name, err)
+			continue
+		}
+
+		// Devices are only unique within a file, every WGConfig file holding its own [Interface]
+		device := file + "\x00" + strings.ToLower(section.name)
+		switch section.kind() {
+		case "interface":
+			if previous, ok := v.devices[device]; ok {
+				v.report(file, section.line, "duplicate [%s], already defined at line %d", section.name, previous.line)
+				continue
+			}
+			v.devices[device] = section
+			err = parseInterfaceSection(parsed, &DeviceConfig{})
+		case "peer":
+			var parsedPeers []PeerConfig
+			err = parsePeerSections([]*ini.Section{parsed}, &parsedPeers)
+			if err == nil {
+				group := strings.Replace(device, "peer", "interface", 1)
+				v.peers[group] = append(v.peers[group], peerAt{section, parsedPeers[0]})
+			}
+		case "socks5", "http", "mixed", "transparenttcp", "sniproxy":
+			var routine RoutineSpawner
+			switch section.kind() {
+			case "socks5":
+				routine, err = parseSocks5Config(parsed)
+			case "http":
+				routine, err = parseHTTPConfig(parsed)
+			case "transparenttcp":
+				routine, err = parseTransparentTCPConfig(parsed)
+			case "sniproxy":
+				routine, err = parseSNIProxyConfig(parsed)
+			default:
+				routine, err = parseMixedConfig(parsed)
+			}
+			switch routine := routine.(type) {
+			case *Socks5Config:
+				v.routines = append(v.routines, routineAt{section, routine.BindAddress, routine.TunnelSelection, false, true})
+			case *HTTPConfig:
+				v.routines = append(v.routines, routineAt{section, routine.BindAddress, routine.TunnelSelection, false, true})
+			case *MixedConfig:
+				v.routines = append(v.routines, routineAt{section, routine.BindAddress, routine.TunnelSelection, false, true})
+			case *TransparentTCPConfig:
+				v.routines = append(v.routines, routineAt{section, routine.BindAddress, routine.TunnelSelection, false, false})
+			case *SNIProxyConfig:
+				v.routines = append(v.routines, routineAt{section, routine.BindAddress, routine.TunnelSelection, true, false})
+			}
+		case "rule":
+			_, err = parseRouteRule(parsed, v.tunnels)
+		case "user":
+			_, err = parseUserPolicy(parsed)
+		case "pac":
+			_, err = parsePACConfig(parsed)
+		}
+		if err != nil {
+			v.report(file, section.line, "[%s]: %v", section.name, err)
+		}
+	}
+}
+
+// checkConfiguration parses cfg, read from file, and checks the sections of all the files against each other
+func (v *validator) checkConfiguration(cfg *ini.File, file string) {
+	conf, err := parse(cfg, file)
+	if err != nil {
+		v.report(file, 0, "%v", err)
+		return
+	}
+
+	for _, group := range v.peers {
+		for i, peer := range group {
+			for _, previous := range group[:i] {
+				if prefix, ok := overlappingPrefix(peer.peer, previous.peer); ok {
+					v.report(peer.section.file, peer.section.keyLine("AllowedIPs"), "AllowedIPs %s overlaps with the peer at line %d", prefix, previous.section.line)
+				}
+			}
+		}
+	}
+
+	domainTargets := hasDomainTargets(conf)
+	for i, routine := range v.routines {
+		for _, previous := range v.routines[:i] {
+			if bindAddressesCollide(routine.bindAddress, previous.bindAddress) {
+				v.report(routine.section.file, routine.section.keyLine("BindAddress"), "BindAddress %s collides with [%s] at %s",
+					routine.bindAddress, previous.section.name, v.location(previous.section, routine.section.file))
+			}
+		}
+
+		if !routine.hostNames && !(routine.domainTargets && domainTargets) {
+			continue
+		}
+		devices := routine.selection.Devices
+		if len(devices) == 0 {
+			devices = []string{""}
+		}
+		for _, name := range devices {
+			device := conf.Device
+			if name != "" {
+				device = conf.Tunnels[name]
+			}
+			if len(device.DNS) == 0 {
+				v.report(routine.section.file, routine.section.line, "[%s]: device %s has no DNS server to resolve host names", routine.section.name, deviceLabel(device))
+			}
+		}
+	}
+}
+
+// sort orders the diagnostics by file, then by line
+func (v *validator) sort() {
+	order := make(map[string]int)
+	for i, file := range v.files {
+		if _, ok := order[file]; !ok {
+			order[file] = i
+		}
+	}
+	sort.SliceStable(v.diagnostics, func(i, j int) bool {
+		a, b := v.diagnostics[i], v.diagnostics[j]
+		if order[a.File] != order[b.File] {
+			return order[a.File] < order[b.File]
+		}
+		return a.Line < b.Line
+	})
+}
+
+// hasDomainTargets reports whether a [Rule], [User] or [PAC] section has Domain conditions,
+// the proxies then dialing host names of their own
+func hasDomainTargets(conf *Configuration) bool {
+	for _, rule := range conf.Rules {
+		if len(rule.Domains) > 0 {
+			return true
+		}
+	}
+	for _, user := range conf.Users {
+		if len(user.Destinations.Domains) > 0 {
+			return true
+		}
+	}
+	return conf.PAC != nil && len(conf.PAC.Domains) > 0
+}
+
+// overlappingPrefix returns an AllowedIPs prefix of a overlapping with one of b
+func overlappingPrefix(a, b PeerConfig) (string, bool) {
+	for _, prefix := range a.AllowedIPs {
+		for _, other := range b.AllowedIPs {
+			if prefix.Overlaps(other) {
+				return prefix.String(), true
+			}
+		}
+	}
+	return "", false
+}
+
+// bindAddressesCollide reports whether listening on a and b would conflict
+func bindAddressesCollide(a, b string) bool {
+	hostA, portA, err := net.SplitHostPort(a)
+	if err != nil {
+		return a == b
+	}
+	hostB, portB, err := net.SplitHostPort(b)
+	if err != nil || portA != portB {
+		return false
+	}
+	unspecified := func(host string) bool {
+		ip := net.ParseIP(host)
+		return host == "" || (ip != nil && ip.IsUnspecified())
+	}
+	return hostA == hostB || unspecified(hostA) || unspecified(hostB)
+}
+
+func deviceLabel(device *DeviceConfig) string {
+	if device.Name == "" {
+		return "[Interface]"
+	}
+	return fmt.Sprintf("%q", device.Name)
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
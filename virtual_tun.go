@@ -1,8 +1,11 @@
 package wireproxy
 
 import (
+	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/amnezia-vpn/amneziawg-go/device"
 	"github.com/amnezia-vpn/amneziawg-go/tun/netstack"
@@ -18,4 +21,67 @@ type VirtualTun struct {
 	// PingRecord stores the last time an IP was pinged
 	PingRecord     map[string]uint64
 	PingRecordLock *sync.Mutex
+	// Standby lists lower priority tunnels to fail over to when this one is unhealthy
+	Standby []*VirtualTun
+	// Tunnels holds the named tunnels routines can select with `Device = <name>`
+	Tunnels map[string]*VirtualTun
+	// Rules route the connections of the proxies to a tunnel, the host network or nowhere
+	Rules []*RouteRule
+	// Users restrict the connections of the authenticated proxy users
+	Users map[string]*UserPolicy
+	// PAC is the proxy auto-config file served to browsers, describing Routines
+	PAC      *PACConfig
+	Routines []RoutineSpawner
+
+	handshakeFailed atomic.Bool
+	active          atomic.Pointer[VirtualTun]
+	closed          chan struct{}
+	closeOnce       sync.Once
+	// deviceLock guards Dev and Tnet, replaced when the watchdog rebuilds the device
+	deviceLock   sync.RWMutex
+	lastRotation atomic.Int64
+}
+
+// currentDevice returns the wireguard device of the tunnel
+func (d *VirtualTun) currentDevice() *device.Device {
+	d.deviceLock.RLock()
+	defer d.deviceLock.RUnlock()
+	return d.Dev
+}
+
+// currentNet returns the netstack of the tunnel
+func (d *VirtualTun) currentNet() *netstack.Net {
+	d.deviceLock.RLock()
+	defer d.deviceLock.RUnlock()
+	return d.Tnet
+}
+
+// checkAliveInterval returns the time between two CheckAlive probe rounds
+func (d *VirtualTun) checkAliveInterval() time.Duration {
+	return time.Duration(max(d.Conf.CheckAliveInterval, 1)) * time.Second
+}
+
+// sleep waits for duration, reporting false when the tunnel was closed in the meantime
+func (d *VirtualTun) sleep(duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-d.closed:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Tunnel returns the tunnel a routine configured with `Device = name` should use,
+// an empty name selecting d itself
+func (d *VirtualTun) Tunnel(name string) (*VirtualTun, error) {
+	if name == "" {
+		return d, nil
+	}
+	tunnel, ok := d.Tunnels[name]
+	if !ok {
+		return nil, errors.New("unknown device: " + name)
+	}
+	return tunnel, nil
 }
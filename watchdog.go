@@ -0,0 +1,135 @@
+package wireproxy
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var errTunnelClosed = errors.New("tunnel closed")
+
+// isClosed reports whether the tunnel was closed
+func (d *VirtualTun) isClosed() bool {
+	select {
+	case <-d.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// watchdog tries to recover the tunnel once CheckAlive probes failed RestartThreshold
+// rounds in a row. The first attempt re-resolves the endpoints and re-applies the peers,
+// which forces a new handshake; if the probes keep failing, the device is rebuilt.
+// Attempts are spaced out with an exponential backoff capped at RestartMaxBackoff.
+func (d *VirtualTun) watchdog() {
+	interval := d.checkAliveInterval()
+	maxBackoff := time.Duration(d.Conf.RestartMaxBackoff) * time.Second
+	backoff := interval
+	failures := 0
+	attempts := 0
+
+	for {
+		if !d.sleep(interval) {
+			return
+		}
+
+		if d.pingHealthy() {
+			if attempts > 0 {
+				d.Logger.Verbosef("Watchdog: tunnel recovered after %d attempt(s)", attempts)
+			}
+			failures = 0
+			attempts = 0
+			backoff = interval
+			continue
+		}
+
+		failures++
+		if failures < d.Conf.RestartThreshold {
+			continue
+		}
+		failures = 0
+		attempts++
+
+		if attempts == 1 {
+			d.Logger.Errorf("Watchdog: %d probe rounds failed, re-applying peers", d.Conf.RestartThreshold)
+			if err := d.reapplyPeers(); err != nil {
+				d.Logger.Errorf("Watchdog: failed to re-apply peers: %v", err)
+			}
+		} else {
+			d.Logger.Errorf("Watchdog: tunnel still unhealthy, rebuilding device (attempt %d)", attempts)
+			if err := d.rebuildDevice(); err != nil {
+				d.Logger.Errorf("Watchdog: failed to rebuild device: %v", err)
+			}
+		}
+
+		d.Logger.Verbosef("Watchdog: waiting %s before checking again", backoff)
+		if !d.sleep(backoff) {
+			return
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// reapplyPeers resolves the peer endpoints again and pushes the peers to the device
+func (d *VirtualTun) reapplyPeers() error {
+	d.Conf.endpointLock.Lock()
+	defer d.Conf.endpointLock.Unlock()
+
+	if err := resolveEndpoints(context.Background(), d.Conf); err != nil {
+		return err
+	}
+
+	setting, err := CreatePeerIPCRequest(d.Conf)
+	if err != nil {
+		return err
+	}
+	return d.currentDevice().IpcSet(setting.IpcRequest)
+}
+
+// rebuildDevice tears down the current device and replaces it with a fresh one
+func (d *VirtualTun) rebuildDevice() error {
+	if d.isClosed() {
+		return errTunnelClosed
+	}
+
+	d.Conf.endpointLock.Lock()
+	err := resolveEndpoints(context.Background(), d.Conf)
+	d.Conf.endpointLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The hooks read the peer endpoints, they must not run under endpointLock
+	d.runHooks(HookDown, d.Conf.OnDown, nil)
+	if err := d.replaceDevice(); err != nil {
+		return err
+	}
+	go d.runHooks(HookUp, d.Conf.OnUp, nil)
+
+	return nil
+}
+
+// replaceDevice closes the device and swaps it for a new one, unless the tunnel was closed
+func (d *VirtualTun) replaceDevice() error {
+	d.Conf.endpointLock.Lock()
+	defer d.Conf.endpointLock.Unlock()
+	d.deviceLock.Lock()
+	defer d.deviceLock.Unlock()
+
+	if d.isClosed() {
+		return errTunnelClosed
+	}
+	d.Dev.Close()
+
+	dev, tnet, err := d.createDevice()
+	if err != nil {
+		return err
+	}
+	d.Dev = dev
+	d.Tnet = tnet
+	return nil
+}
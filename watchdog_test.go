@@ -0,0 +1,136 @@
+package wireproxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+func TestRebuildDevice(t *testing.T) {
+	conf, err := ParseConfigString(`
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = 192.0.2.1:51820
+AllowedIPs = 10.5.0.1/32`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vt, err := StartWireguard(conf.Device, device.NewLogger(device.LogLevelSilent, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Dials read the device while the watchdog replaces it
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			if conn, err := vt.currentNet().Dial("udp", "10.5.0.1:53"); err == nil {
+				_ = conn.Close()
+			}
+		}
+	}()
+	if err := vt.rebuildDevice(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	vt.Close()
+	if vt.sleep(time.Hour) {
+		t.Error("sleep should stop once the tunnel is closed")
+	}
+	if err := vt.rebuildDevice(); err == nil {
+		t.Error("a closed tunnel should not be rebuilt")
+	}
+}
+
+// logRecorder collects the log lines of a tunnel
+type logRecorder struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (r *logRecorder) logf(format string, args ...any) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lines = append(r.lines, fmt.Sprintf(format, args...))
+}
+
+// waitFor waits for a line containing substr, failing the test after timeout
+func (r *logRecorder) waitFor(t *testing.T, substr string, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		r.lock.Lock()
+		for _, line := range r.lines {
+			if strings.Contains(line, substr) {
+				r.lock.Unlock()
+				return
+			}
+		}
+		r.lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no log line containing %q", substr)
+}
+
+func TestWatchdog(t *testing.T) {
+	conf, err := ParseConfigString(`
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = 192.0.2.1:51820
+AllowedIPs = 10.5.0.1/32`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &logRecorder{}
+	vt, err := StartWireguard(conf.Device, &device.Logger{Verbosef: recorder.logf, Errorf: recorder.logf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(vt.Close)
+
+	// A probe answered long ago keeps the tunnel unhealthy
+	vt.Conf.CheckAliveInterval = 1
+	vt.Conf.RestartThreshold = 1
+	vt.Conf.RestartMaxBackoff = 2
+	vt.PingRecord = map[string]uint64{"10.5.0.1": 0}
+	dev := vt.currentDevice()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		vt.watchdog()
+	}()
+
+	recorder.waitFor(t, "re-applying peers", 5*time.Second)
+	recorder.waitFor(t, "waiting 1s", time.Second)
+	if vt.currentDevice() != dev {
+		t.Error("the first attempt should re-apply the peers, not rebuild the device")
+	}
+
+	recorder.waitFor(t, "rebuilding device (attempt 2)", 5*time.Second)
+	recorder.waitFor(t, "waiting 2s", time.Second)
+	if vt.currentDevice() == dev {
+		t.Error("the second attempt should rebuild the device")
+	}
+
+	vt.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("watchdog should return once the tunnel is closed")
+	}
+}
@@ -0,0 +1,92 @@
+package wireproxy
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/amnezia-vpn/amneziawg-go/conn"
+	"github.com/amnezia-vpn/amneziawg-go/device"
+	"github.com/amnezia-vpn/amneziawg-go/tun/netstack"
+)
+
+// StartWireguard creates a tun interface on netstack given a configuration
+func StartWireguard(conf *DeviceConfig, logger *device.Logger) (*VirtualTun, error) {
+	vt := &VirtualTun{
+		Logger:         logger,
+		Conf:           conf,
+		PingRecord:     make(map[string]uint64),
+		PingRecordLock: new(sync.Mutex),
+		closed:         make(chan struct{}),
+	}
+
+	if err := resolveEndpoints(context.Background(), conf); err != nil {
+		return nil, err
+	}
+
+	dev, tnet, err := vt.createDevice()
+	if err != nil {
+		return nil, err
+	}
+	vt.deviceLock.Lock()
+	vt.Dev = dev
+	vt.Tnet = tnet
+	vt.deviceLock.Unlock()
+	vt.startHooks()
+
+	return vt, nil
+}
+
+// createDevice sets up a new netstack and wireguard device from d.Conf and brings it up
+func (d *VirtualTun) createDevice() (*device.Device, *netstack.Net, error) {
+	setting, err := CreateIPCRequest(d.Conf, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tun, tnet, err := netstack.CreateNetTUN(setting.DeviceAddr, setting.DNS, setting.MTU)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dev := device.NewDevice(tun, conn.NewDefaultBind(), d.Logger, d.Conf.DomainBlockingEnabled, d.statusChanged)
+	if err := dev.IpcSet(setting.IpcRequest); err != nil {
+		dev.Close()
+		return nil, nil, err
+	}
+
+	if err := dev.Up(); err != nil {
+		dev.Close()
+		return nil, nil, err
+	}
+
+	return dev, tnet, nil
+}
+
+// resolveEndpoints resolves every peer endpoint given as a hostname or an SRV name on the host
+// network into its candidate addresses, so that it can be passed to the device. Peers that were
+// resolved before are looked up again.
+func resolveEndpoints(ctx context.Context, conf *DeviceConfig) error {
+	for i := range conf.Peers {
+		peer := &conf.Peers[i]
+		host, port := peer.hostname, ""
+		if host == "" {
+			if !peer.NeedsResolution() {
+				continue
+			}
+			host = *peer.Endpoint
+			if h, p, err := net.SplitHostPort(host); err == nil {
+				host, port = h, p
+			}
+		} else if !isSRVName(host) {
+			_, port, _ = net.SplitHostPort(*peer.Endpoint)
+		}
+
+		candidates, err := lookupEndpoint(ctx, host, port)
+		if err != nil {
+			return err
+		}
+		peer.setEndpointCandidates(host, candidates)
+	}
+	return nil
+}